@@ -0,0 +1,66 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"sort"
+
+	"github.com/tsuru/prometheus-conntrack/workload"
+)
+
+type indexedAddress struct {
+	workload string
+	// order is the position of the address among the addresses of all
+	// workloads, matches are accumulated in this order
+	order int
+}
+
+// addressIndex maps the addresses of workloads to them, so every conntrack
+// entry is classified by looking up its addresses once instead of being
+// compared with the addresses of every workload.
+type addressIndex struct {
+	m    map[string][]indexedAddress
+	size int
+}
+
+type addressMatch struct {
+	workload string
+	ip       string
+	order    int
+}
+
+func (x *addressIndex) add(w *workload.Workload) {
+	if x.m == nil {
+		x.m = map[string][]indexedAddress{}
+	}
+	for _, ip := range w.Addresses() {
+		if ip == "" {
+			continue
+		}
+		x.m[ip] = append(x.m[ip], indexedAddress{workload: w.Name, order: x.size})
+		x.size++
+	}
+}
+
+// match appends to matches the workload addresses found on the origin,
+// destination or translated destination of conn. A workload address is
+// matched once, as origin when it is both.
+func (x *addressIndex) match(conn *Conn, matches []addressMatch) []addressMatch {
+	translatedIP, _ := conn.TranslatedDestination()
+	ips := [3]string{conn.OriginIP, conn.DestIP, translatedIP}
+	for i, ip := range ips {
+		if (i > 0 && ip == ips[0]) || (i > 1 && ip == ips[1]) {
+			continue
+		}
+		for _, address := range x.m[ip] {
+			matches = append(matches, addressMatch{workload: address.workload, ip: ip, order: address.order})
+		}
+	}
+
+	if len(matches) > 1 {
+		sort.Slice(matches, func(i, j int) bool { return matches[i].order < matches[j].order })
+	}
+	return matches
+}
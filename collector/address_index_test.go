@@ -0,0 +1,33 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tsuru/prometheus-conntrack/workload"
+)
+
+func TestAddressIndexMatch(t *testing.T) {
+	index := addressIndex{}
+	index.add(&workload.Workload{Name: "w1", IPs: []string{"10.10.1.2", "fd00:10:10::2"}})
+	index.add(&workload.Workload{Name: "w2", IP: "10.10.1.3"})
+	index.add(&workload.Workload{Name: "w3"})
+	index.add(&workload.Workload{Name: "w4", IP: "10.10.1.3"})
+
+	assert.Equal(t, []addressMatch{
+		{workload: "w1", ip: "10.10.1.2", order: 0},
+		{workload: "w2", ip: "10.10.1.3", order: 2},
+		{workload: "w4", ip: "10.10.1.3", order: 3},
+	}, index.match(&Conn{OriginIP: "10.10.1.3", DestIP: "10.96.0.1", ReplyOriginIP: "10.10.1.2"}, nil))
+
+	assert.Equal(t, []addressMatch{
+		{workload: "w1", ip: "10.10.1.2", order: 0},
+	}, index.match(&Conn{OriginIP: "10.10.1.2", DestIP: "10.10.1.2"}, nil))
+
+	assert.Empty(t, index.match(&Conn{OriginIP: "192.168.50.4", DestIP: "192.168.50.5"}, nil))
+	assert.Empty(t, index.match(&Conn{}, nil))
+}
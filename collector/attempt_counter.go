@@ -0,0 +1,50 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"sync"
+	"time"
+)
+
+type attemptKey struct {
+	connTrafficKey
+	Protocol string
+	Result   string
+}
+
+type attemptValue struct {
+	Count    uint64
+	LastUsed time.Time
+}
+
+// attemptCounter counts the outcomes of the outgoing connections of workloads,
+// they are only known when the connections are reported as closed.
+type attemptCounter struct {
+	sync.Mutex
+	m map[attemptKey]*attemptValue
+}
+
+func newAttemptCounter() *attemptCounter {
+	return &attemptCounter{m: map[attemptKey]*attemptValue{}}
+}
+
+func (a *attemptCounter) Inc(key attemptKey, now time.Time) {
+	v, ok := a.m[key]
+	if !ok {
+		v = &attemptValue{}
+		a.m[key] = v
+	}
+	v.Count++
+	v.LastUsed = now
+}
+
+func (a *attemptCounter) clean(now time.Time) {
+	for key, value := range a.m {
+		if now.After(value.LastUsed.Add(unusedConnectionTTL)) {
+			delete(a.m, key)
+		}
+	}
+}
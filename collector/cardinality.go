@@ -0,0 +1,173 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// overflowDestination replaces the destinations beyond the limits
+const overflowDestination = "other"
+
+var droppedSeriesDesc = prometheus.NewDesc("conntrack_dropped_series_total", "Number of destinations and series aggregated on destination=\"other\" by the cardinality limits", []string{"reason"}, nil)
+
+type guardedDestination struct {
+	workload    string
+	destination destination
+	translated  destination
+}
+
+// cardinalityGuard limits the destinations tracked per workload and the
+// connection series (workload, destination, state and the other dimensions)
+// in total. Destinations and series seen after a limit is reached are
+// aggregated on a single overflow destination until the tracked ones are
+// unused for a while.
+type cardinalityGuard struct {
+	sync.Mutex
+	maxPerWorkload int
+	maxSeries      int
+
+	destinations  map[guardedDestination]time.Time
+	perWorkload   map[string]int
+	refused       map[guardedDestination]time.Time
+	series        map[accumulatorKey]time.Time
+	refusedSeries map[accumulatorKey]time.Time
+	// number of tracked series per destination, used to account closed
+	// connections
+	seriesDestinations map[guardedDestination]int
+	dropped            map[string]uint64
+}
+
+func newCardinalityGuard(maxPerWorkload, maxSeries int) *cardinalityGuard {
+	g := &cardinalityGuard{
+		maxPerWorkload: maxPerWorkload,
+		maxSeries:      maxSeries,
+		destinations:   map[guardedDestination]time.Time{},
+		perWorkload:    map[string]int{},
+		refused:        map[guardedDestination]time.Time{},
+		series:         map[accumulatorKey]time.Time{},
+		refusedSeries:  map[accumulatorKey]time.Time{},
+		dropped:        map[string]uint64{},
+
+		seriesDestinations: map[guardedDestination]int{},
+	}
+	// the enabled limits are exported from zero
+	if maxPerWorkload > 0 {
+		g.dropped["workload_limit"] = 0
+	}
+	if maxSeries > 0 {
+		g.dropped["series_limit"] = 0
+	}
+	return g
+}
+
+// admit returns the destinations to account conn of workload on, which are
+// the overflow destination when the workload reached its limit.
+func (g *cardinalityGuard) admit(workload string, d, translated destination, now time.Time) (destination, destination) {
+	if g.maxPerWorkload == 0 {
+		return d, translated
+	}
+
+	key := guardedDestination{workload: workload, destination: d, translated: translated}
+	if _, ok := g.destinations[key]; ok {
+		g.destinations[key] = now
+		return d, translated
+	}
+
+	if g.perWorkload[workload] < g.maxPerWorkload {
+		g.destinations[key] = now
+		g.perWorkload[workload]++
+		return d, translated
+	}
+
+	if _, ok := g.refused[key]; !ok {
+		g.dropped["workload_limit"]++
+	}
+	g.refused[key] = now
+	overflow := destination{ip: overflowDestination}
+	return overflow, overflow
+}
+
+// admitSeries returns the key to account a connection on, its destinations
+// are replaced by the overflow destination when the series limit was reached.
+// Overflow series are not limited.
+func (g *cardinalityGuard) admitSeries(key accumulatorKey, now time.Time) accumulatorKey {
+	if g.maxSeries == 0 || key.destination.ip == overflowDestination {
+		return key
+	}
+
+	if _, ok := g.series[key]; ok {
+		g.series[key] = now
+		return key
+	}
+	if len(g.series) < g.maxSeries {
+		g.series[key] = now
+		g.seriesDestinations[seriesDestination(key)]++
+		return key
+	}
+
+	if _, ok := g.refusedSeries[key]; !ok {
+		g.dropped["series_limit"]++
+	}
+	g.refusedSeries[key] = now
+	key.destination = destination{ip: overflowDestination}
+	key.translatedDestination = key.destination
+	return key
+}
+
+// admitClosed returns the destinations to account the traffic of a closed
+// connection on without tracking a series for it, they are kept when a series
+// to the same destinations is tracked or there is room for one.
+func (g *cardinalityGuard) admitClosed(workload string, d, translated destination) (destination, destination) {
+	if g.maxSeries == 0 || d.ip == overflowDestination {
+		return d, translated
+	}
+
+	key := guardedDestination{workload: workload, destination: d, translated: translated}
+	if g.seriesDestinations[key] > 0 || len(g.series) < g.maxSeries {
+		return d, translated
+	}
+	overflow := destination{ip: overflowDestination}
+	return overflow, overflow
+}
+
+func seriesDestination(key accumulatorKey) guardedDestination {
+	return guardedDestination{workload: key.workload, destination: key.destination, translated: key.translatedDestination}
+}
+
+func (g *cardinalityGuard) clean(now time.Time) {
+	for key, lastUsed := range g.destinations {
+		if now.After(lastUsed.Add(unusedConnectionTTL)) {
+			delete(g.destinations, key)
+			g.perWorkload[key.workload]--
+			if g.perWorkload[key.workload] == 0 {
+				delete(g.perWorkload, key.workload)
+			}
+		}
+	}
+	for key, lastUsed := range g.refused {
+		if now.After(lastUsed.Add(unusedConnectionTTL)) {
+			delete(g.refused, key)
+		}
+	}
+	for key, lastUsed := range g.series {
+		if now.After(lastUsed.Add(unusedConnectionTTL)) {
+			delete(g.series, key)
+			dest := seriesDestination(key)
+			g.seriesDestinations[dest]--
+			if g.seriesDestinations[dest] == 0 {
+				delete(g.seriesDestinations, dest)
+			}
+		}
+	}
+	for key, lastUsed := range g.refusedSeries {
+		if now.After(lastUsed.Add(unusedConnectionTTL)) {
+			delete(g.refusedSeries, key)
+		}
+	}
+}
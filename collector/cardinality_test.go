@@ -0,0 +1,94 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityGuard(t *testing.T) {
+	now := time.Now().UTC()
+	g := newCardinalityGuard(2, 0)
+	d1 := destination{ip: "192.168.50.4", port: 443}
+	d2 := destination{ip: "192.168.50.5", port: 443}
+	d3 := destination{ip: "192.168.50.6", port: 443}
+	overflow := destination{ip: overflowDestination}
+
+	for i := 0; i < 2; i++ {
+		d, translated := g.admit("w1", d1, d1, now)
+		assert.Equal(t, d1, d)
+		assert.Equal(t, d1, translated)
+		d, _ = g.admit("w1", d2, d2, now)
+		assert.Equal(t, d2, d)
+		d, translated = g.admit("w1", d3, d3, now)
+		assert.Equal(t, overflow, d)
+		assert.Equal(t, overflow, translated)
+	}
+	assert.Equal(t, map[string]uint64{"workload_limit": 1}, g.dropped)
+
+	d, _ := g.admit("w2", d3, d3, now)
+	assert.Equal(t, d3, d)
+
+	// only w2 keeps being seen, the destinations of w1 expire
+	later := now.Add(unusedConnectionTTL)
+	g.admit("w2", d3, d3, later)
+	g.clean(later.Add(time.Second))
+	assert.Equal(t, map[string]int{"w2": 1}, g.perWorkload)
+	assert.Empty(t, g.refused)
+	d, _ = g.admit("w1", d3, d3, later)
+	assert.Equal(t, d3, d)
+}
+
+func TestCardinalityGuardSeries(t *testing.T) {
+	now := time.Now().UTC()
+	g := newCardinalityGuard(0, 2)
+	d := destination{ip: "192.168.50.4", port: 443}
+	established := accumulatorKey{workload: "w1", state: "ESTABLISHED", destination: d, translatedDestination: d}
+	timeWait := accumulatorKey{workload: "w1", state: "TIME-WAIT", destination: d, translatedDestination: d}
+	other := accumulatorKey{workload: "w2", state: "ESTABLISHED", destination: d, translatedDestination: d}
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, established, g.admitSeries(established, now))
+		assert.Equal(t, timeWait, g.admitSeries(timeWait, now))
+		key := g.admitSeries(other, now)
+		assert.Equal(t, overflowDestination, key.destination.ip)
+		assert.Equal(t, overflowDestination, key.translatedDestination.ip)
+		assert.Equal(t, key, g.admitSeries(key, now))
+	}
+	assert.Equal(t, map[string]uint64{"series_limit": 1}, g.dropped)
+
+	later := now.Add(unusedConnectionTTL)
+	g.admitSeries(established, later)
+	g.clean(later.Add(time.Second))
+	assert.Len(t, g.series, 1)
+	assert.Empty(t, g.refusedSeries)
+	assert.Equal(t, other, g.admitSeries(other, later))
+}
+
+func TestCardinalityGuardClosed(t *testing.T) {
+	now := time.Now().UTC()
+	g := newCardinalityGuard(0, 1)
+	d := destination{ip: "192.168.50.4", port: 443}
+	d2 := destination{ip: "192.168.50.5", port: 443}
+
+	closed, _ := g.admitClosed("w1", d2, d2)
+	assert.Equal(t, d2, closed)
+	assert.Empty(t, g.series)
+
+	established := accumulatorKey{workload: "w1", state: "ESTABLISHED", destination: d, translatedDestination: d}
+	g.admitSeries(established, now)
+	closed, _ = g.admitClosed("w1", d, d)
+	assert.Equal(t, d, closed)
+	closed, translated := g.admitClosed("w1", d2, d2)
+	assert.Equal(t, overflowDestination, closed.ip)
+	assert.Equal(t, overflowDestination, translated.ip)
+	assert.Equal(t, map[string]uint64{"series_limit": 0}, g.dropped)
+
+	g.clean(now.Add(unusedConnectionTTL + time.Second))
+	assert.Empty(t, g.seriesDestinations)
+}
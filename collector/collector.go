@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	ct "github.com/florianl/go-conntrack"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tsuru/prometheus-conntrack/workload"
 
@@ -19,8 +21,8 @@ import (
 )
 
 var (
-	connectionLabels  = []string{"state", "protocol", "destination", "destination_name", "destination_zone", "direction"}
-	originBytesLabels = []string{"destination", "destination_name", "destination_zone"}
+	connectionLabels  = []string{"state", "protocol", "destination", "destination_name", "destination_zone", "direction", "ip_family", "translated_destination", "status"}
+	originBytesLabels = []string{"destination", "destination_name", "destination_zone", "ip_family", "translated_destination"}
 
 	unusedConnectionTTL = 2 * time.Minute
 )
@@ -28,8 +30,9 @@ var (
 type ConnDirection string
 
 var (
-	OutgoingConnection = ConnDirection("outgoing")
-	IncomingConnection = ConnDirection("incoming")
+	OutgoingConnection  = ConnDirection("outgoing")
+	IncomingConnection  = ConnDirection("incoming")
+	ForwardedConnection = ConnDirection("forwarded")
 )
 
 type Conntrack func() ([]*Conn, error)
@@ -37,48 +40,172 @@ type Conntrack func() ([]*Conn, error)
 type destination struct {
 	ip   string
 	port uint16
+	// icmp holds the ICMP type and code, which are tracked instead of ports
+	icmp string
 }
 
 func (d *destination) String() string {
-	return fmt.Sprintf("%s:%d", d.ip, d.port)
+	return formatDestination(d.ip, d.port, d.icmp)
+}
+
+// formatDestination renders ip and port, protocols without ports are
+// rendered with the ICMP type and code (ie: ICMP) or only with the IP (ie: GRE).
+func formatDestination(ip string, port uint16, icmp string) string {
+	if icmp != "" {
+		return strings.TrimSpace(ip + " " + icmp)
+	}
+	if port == 0 {
+		return ip
+	}
+
+	return net.JoinHostPort(ip, strconv.Itoa(int(port)))
 }
 
 type accumulatorKey struct {
-	workload    string
-	state       string
-	protocol    string
-	destination destination
-	direction   ConnDirection
+	workload              string
+	state                 string
+	protocol              string
+	destination           destination
+	translatedDestination destination
+	direction             ConnDirection
+	family                string
+	status                string
+	zone                  uint16
+	mark                  uint32
+	connlabels            string
+	source                connSource
+}
+
+// connSource is the origin of incoming connections, either its IP or only
+// its CIDR class when sources are collapsed.
+type connSource struct {
+	ip   string
+	zone string
+}
+
+// connDestinations finds the direction of conn from the point of view of a
+// local address, the reply tuple is used to match connections that were
+// DNAT'ed to the local address (ie: kubernetes services). The original
+// destination is returned along with the translated one, which is the real
+// peer of the connection.
+func connDestinations(conn *Conn, isLocal func(ip string) bool) (d, translated destination, direction ConnDirection, ok bool) {
+	translatedIP, translatedPort := conn.TranslatedDestination()
+	icmp := conn.ICMP()
+
+	switch {
+	case isLocal(conn.OriginIP):
+		return destination{conn.DestIP, conn.DestPort, icmp}, destination{translatedIP, translatedPort, icmp}, OutgoingConnection, true
+	case isLocal(conn.DestIP), isLocal(translatedIP):
+		return destination{"", conn.DestPort, icmp}, destination{"", translatedPort, icmp}, IncomingConnection, true
+	}
+
+	return destination{}, destination{}, "", false
+}
+
+// Opts are optional settings of the collector
+type Opts struct {
+	// ZoneLabel adds the conntrack zone as a label of connections and traffic metrics
+	ZoneLabel bool
+	// MarkLabel adds the conntrack mark as a label of connections and traffic metrics,
+	// marks found in MarkClasses are replaced by their class names
+	MarkLabel   bool
+	MarkClasses map[uint32]string
+	// ConnlabelsLabel adds the connlabel bits of the connection as a label of
+	// connections and traffic metrics, bits found in ConnlabelNames are
+	// replaced by their names
+	ConnlabelsLabel bool
+	ConnlabelNames  map[int]string
+	// NetNSConntrack turns on the collection of the conntrack table of each
+	// workload network namespace, ProcPath is the mount point of the host
+	// procfs used to reach the namespaces by PID
+	NetNSConntrack NetNSConntrack
+	ProcPath       string
+	// ConnectionAttempts counts the closed connections by result, only
+	// conntrack sources that report closed connections (ie: events) feed it
+	ConnectionAttempts bool
+	// DNSHealth turns on the metrics of workload DNS flows, it also reads the
+	// conntrack statistics from CPUStats to correlate them with insert_failed
+	DNSHealth bool
+	CPUStats  *CPUStats
+	// PollInterval turns on a background loop that polls the workloads and the
+	// conntrack entries, scrapes are served from the latest snapshot
+	PollInterval time.Duration
+	// MaxDestinationsPerWorkload limits the destinations tracked per workload
+	// and MaxSeries the connection series in total, the ones beyond are
+	// aggregated on destination="other". Zero means no limit.
+	MaxDestinationsPerWorkload int
+	MaxSeries                  int
+	// DestinationWorkloadLabel adds the workload owning the destination as
+	// destination_workload, along with its labels, to connections and traffic metrics
+	DestinationWorkloadLabel bool
+	// SourceLabel adds the origin of incoming and forwarded connections as source, source_name
+	// and source_zone to connections and traffic metrics, SourceClasses keeps
+	// only the CIDR class of the origin to limit the cardinality
+	SourceLabel   bool
+	SourceClasses bool
+	// Forwarded turns on the node metrics of connections that only pass
+	// through the node (ie: gateways) with direction="forwarded", it implies
+	// SourceLabel
+	Forwarded bool
+	// SourcePorts turns on the count of source ports in use per destination,
+	// compared with net.ipv4.ip_local_port_range
+	SourcePorts bool
+	// ConnectionAge turns on the age and lifetime histograms of workload
+	// connections and SynSent the age metrics of the ones stuck on SYN-SENT,
+	// both depend on conntrack timestamps
+	ConnectionAge bool
+	SynSent       bool
 }
 
 type ConntrackCollector struct {
+	opts                      Opts
 	engine                    workload.Engine
 	conntrack                 Conntrack
 	workloadLabels            []string
 	sanitizedWorkloadLabels   []string
 	connectionMetricTupleSize int
+	connectionLabels          []string
+	trafficLabels             []string
 	fetchWorkloads            prometheus.Counter
 	fetchWorkloadFailures     prometheus.Counter
 	dnsCache                  DNSCache
 
 	nodeIPs map[string]struct{}
+	// localIPs are all the addresses of the node, including the ones that are
+	// not node IPs, connections from or to them are not forwarded
+	localIPs map[string]struct{}
 	// lastUsedWorkloadTuples works such as a TTL, prometheus needs to know when connection is closed
 	// then we will inform metric with 0 value for a while
 	lastUsedWorkloadTuples sync.Map
 
 	trafficCounter      *trafficCounter
+	connAges            *connAgeTracker
+	attempts            *attemptCounter
+	dnsHealth           *dnsHealth
+	cardinality         *cardinalityGuard
+	sourcePorts         *sourcePorts
 	cidrClassifier      *cidrClassifier
 	cidrClassifierMutex sync.Mutex
+	// addressWorkloads maps the workload addresses to the workloads while
+	// sending metrics, guarded by cidrClassifierMutex
+	addressWorkloads map[string]*workload.Workload
+
+	snapshotMutex sync.Mutex
+	snapshot      *snapshot
 }
 
-func New(engine workload.Engine, conntrack Conntrack, workloadLabels []string, dnsCache DNSCache, classifier *cidrClassifier) (*ConntrackCollector, error) {
+func New(engine workload.Engine, conntrack Conntrack, workloadLabels []string, dnsCache DNSCache, classifier *cidrClassifier, opts Opts) (*ConntrackCollector, error) {
 	sanitizedWorkloadLabels := []string{engine.Kind()}
 	for _, workloadLabel := range workloadLabels {
 		sanitizedWorkloadLabels = append(sanitizedWorkloadLabels, "label_"+promstrutil.SanitizeLabelName(workloadLabel))
 	}
 
 	if dnsCache == nil {
-		dnsCache = newDNSCache()
+		dnsCache = NewDNSCache(DefaultDNSWorkers, DefaultDNSQueueSize, DefaultDNSTimeout)
+	}
+
+	if opts.ProcPath == "" {
+		opts.ProcPath = "/proc"
 	}
 
 	ips, err := nodeIPs()
@@ -90,14 +217,51 @@ func New(engine workload.Engine, conntrack Conntrack, workloadLabels []string, d
 		fmt.Println("Found node IP:", ip)
 	}
 
+	var locals map[string]struct{}
+	if opts.Forwarded {
+		locals, err = localIPs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dimensionLabels := []string{}
+	if opts.ZoneLabel {
+		dimensionLabels = append(dimensionLabels, "zone")
+	}
+	if opts.MarkLabel {
+		dimensionLabels = append(dimensionLabels, "mark")
+	}
+	if opts.ConnlabelsLabel {
+		dimensionLabels = append(dimensionLabels, "connlabels")
+	}
+	if opts.DestinationWorkloadLabel {
+		dimensionLabels = append(dimensionLabels, "destination_workload")
+		for _, workloadLabel := range workloadLabels {
+			dimensionLabels = append(dimensionLabels, "destination_label_"+promstrutil.SanitizeLabelName(workloadLabel))
+		}
+	}
+	if opts.SourceClasses || opts.Forwarded {
+		opts.SourceLabel = true
+	}
+	if opts.SourceLabel {
+		dimensionLabels = append(dimensionLabels, "source", "source_name", "source_zone")
+	}
+	collectorConnectionLabels := append(append([]string{}, connectionLabels...), dimensionLabels...)
+	collectorTrafficLabels := append(append([]string{}, originBytesLabels...), dimensionLabels...)
+
 	collector := &ConntrackCollector{
+		opts:                      opts,
 		engine:                    engine,
 		conntrack:                 conntrack,
 		workloadLabels:            workloadLabels,
 		sanitizedWorkloadLabels:   sanitizedWorkloadLabels,
-		connectionMetricTupleSize: 1 + len(workloadLabels) + len(connectionLabels),
+		connectionMetricTupleSize: 1 + len(workloadLabels) + len(collectorConnectionLabels),
+		connectionLabels:          collectorConnectionLabels,
+		trafficLabels:             collectorTrafficLabels,
 		dnsCache:                  dnsCache,
 		nodeIPs:                   ips,
+		localIPs:                  locals,
 		fetchWorkloads: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: "conntrack",
 			Subsystem: "workload",
@@ -115,7 +279,29 @@ func New(engine workload.Engine, conntrack Conntrack, workloadLabels []string, d
 		cidrClassifierMutex: sync.Mutex{},
 	}
 
+	if opts.ConnectionAge || opts.SynSent {
+		collector.connAges = newConnAgeTracker(opts.ConnectionAge, opts.SynSent)
+	}
+	if opts.ConnectionAttempts {
+		collector.attempts = newAttemptCounter()
+	}
+	if opts.DNSHealth {
+		if opts.CPUStats == nil {
+			opts.CPUStats = NewCPUStats()
+		}
+		collector.dnsHealth = newDNSHealth(opts.CPUStats)
+	}
+	if opts.MaxDestinationsPerWorkload > 0 || opts.MaxSeries > 0 {
+		collector.cardinality = newCardinalityGuard(opts.MaxDestinationsPerWorkload, opts.MaxSeries)
+	}
+	if opts.SourcePorts {
+		collector.sourcePorts = newSourcePorts()
+	}
+
 	go collector.metricCleaner()
+	if opts.PollInterval > 0 {
+		go collector.poll()
+	}
 	return collector, nil
 }
 
@@ -126,93 +312,370 @@ func (c *ConntrackCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.nodeOriginBytesTotalDesc()
 	ch <- c.workloadReplyBytesTotalDesc()
 	ch <- c.nodeReplyBytesTotalDesc()
+	ch <- c.workloadOriginPacketsTotalDesc()
+	ch <- c.nodeOriginPacketsTotalDesc()
+	ch <- c.workloadReplyPacketsTotalDesc()
+	ch <- c.nodeReplyPacketsTotalDesc()
+	if c.opts.ConnectionAge {
+		ch <- c.workloadConnectionAgeDesc()
+		ch <- c.workloadConnectionLifetimeDesc()
+	}
+	if c.opts.SynSent {
+		ch <- c.workloadSynSentOldestDesc()
+		ch <- c.workloadSynSentAgeDesc()
+	}
+	if c.attempts != nil {
+		ch <- c.workloadConnectionAttemptsDesc()
+	}
+	if c.dnsHealth != nil {
+		c.describeDNSHealth(ch)
+	}
+	if c.opts.PollInterval > 0 {
+		ch <- snapshotAgeDesc
+	}
+	if c.cardinality != nil {
+		ch <- droppedSeriesDesc
+	}
+	if c.sourcePorts != nil {
+		c.describeSourcePorts(ch)
+	}
 }
 
 func (c *ConntrackCollector) Collect(ch chan<- prometheus.Metric) {
-	c.fetchWorkloads.Inc()
+	if c.opts.PollInterval > 0 {
+		c.collectSnapshot(ch)
+		return
+	}
+
+	counts, workloadMap, err := c.update()
 	ch <- c.fetchWorkloads
-	workloads, err := c.engine.Workloads()
+	ch <- c.fetchWorkloadFailures
 	if err != nil {
-		c.fetchWorkloadFailures.Inc()
-		ch <- c.fetchWorkloadFailures
 		log.Print(err)
 		return
 	}
-	ch <- c.fetchWorkloadFailures
+	c.sendMetrics(counts, workloadMap, ch)
+}
+
+// update fetches the workloads and the conntrack entries, accumulating them
+// on the counters of the collector.
+func (c *ConntrackCollector) update() (map[accumulatorKey]int, map[string]*workload.Workload, error) {
+	c.fetchWorkloads.Inc()
+	workloads, err := c.engine.Workloads()
+	if err != nil {
+		c.fetchWorkloadFailures.Inc()
+		return nil, nil, err
+	}
 
 	conns, err := c.conntrack()
 	if err != nil {
-		log.Print(err)
-		return
+		return nil, nil, err
+	}
+	netnsConns := c.netnsConns(workloads)
+	var cpuStats []ct.CPUStat
+	var cpuStatsErr error
+	if c.dnsHealth != nil {
+		cpuStats, cpuStatsErr = c.dnsHealth.dumpCPUStat()
 	}
 	counts := map[accumulatorKey]int{}
 	workloadMap := map[string]*workload.Workload{}
 
 	c.trafficCounter.Lock()
+	if c.connAges != nil {
+		c.connAges.Lock()
+		c.connAges.begin()
+	}
+	if c.attempts != nil {
+		c.attempts.Lock()
+	}
+	if c.dnsHealth != nil {
+		c.dnsHealth.Lock()
+		c.dnsHealth.begin()
+	}
+	if c.cardinality != nil {
+		c.cardinality.Lock()
+	}
+	if c.sourcePorts != nil {
+		c.sourcePorts.Lock()
+		c.sourcePorts.begin()
+	}
 	now := time.Now().UTC()
 
+	// workloads with their own conntrack table are attributed directly, the
+	// other ones are indexed by address to be matched on the node table
+	index := addressIndex{}
+	netnsAddresses := map[string]struct{}{}
 	for _, workload := range workloads {
-		for _, conn := range conns {
-			var d destination
-			var direction ConnDirection
-			switch workload.IP {
-			case conn.OriginIP:
-				d = destination{conn.DestIP, conn.DestPort}
-				direction = OutgoingConnection
-			case conn.DestIP:
-				d = destination{"", conn.DestPort}
-				direction = IncomingConnection
-			default:
-				continue
-			}
+		workloadMap[workload.Name] = workload
 
-			key := accumulatorKey{
-				workload:    workload.Name,
-				protocol:    conn.Protocol,
-				state:       conn.State,
-				destination: d,
-				direction:   direction,
+		if workloadConns, ok := netnsConns[workload.Name]; ok {
+			addresses := map[string]struct{}{}
+			for _, ip := range workload.Addresses() {
+				addresses[ip] = struct{}{}
+				netnsAddresses[ip] = struct{}{}
+			}
+			isWorkloadIP := func(connIP string) bool {
+				_, ok := addresses[connIP]
+				return ok
 			}
-			counts[key] = counts[key] + 1
 
-			c.trafficCounter.Inc(connTrafficKey{Workload: workload.Name, IP: d.ip, Port: d.port}, conn.ID, conn.OriginBytes, conn.ReplyBytes, now)
+			for _, conn := range workloadConns {
+				d, translated, direction, ok := connDestinations(conn, isWorkloadIP)
+				if !ok {
+					// every entry of the namespace belongs to the workload, the ones
+					// not bound to its addresses (ie: loopback redirects) are outgoing
+					d, translated, direction, _ = connDestinations(conn, func(string) bool { return true })
+				}
+				c.accumulate(counts, workload.Name, conn, d, translated, direction, now)
+				if conn.Closed {
+					c.trafficCounter.Forget(conn.ID)
+				}
+			}
+			continue
 		}
 
-		workloadMap[workload.Name] = workload
+		index.add(workload)
 	}
 
+	isNodeIP := func(connIP string) bool {
+		_, ok := c.nodeIPs[connIP]
+		return ok
+	}
+	matches := []addressMatch{}
 	for _, conn := range conns {
-		var d destination
-		var direction ConnDirection
-
-		if _, ok := c.nodeIPs[conn.OriginIP]; ok {
-			d = destination{conn.DestIP, conn.DestPort}
-			direction = OutgoingConnection
-		} else if _, ok := c.nodeIPs[conn.DestIP]; ok {
-			d = destination{"", conn.DestPort}
-			direction = IncomingConnection
-		} else {
-			continue
+		matches = index.match(conn, matches[:0])
+		for _, match := range matches {
+			isWorkloadIP := func(connIP string) bool { return connIP == match.ip }
+			d, translated, direction, _ := connDestinations(conn, isWorkloadIP)
+			c.accumulate(counts, match.workload, conn, d, translated, direction, now)
 		}
 
-		key := accumulatorKey{
-			protocol:    conn.Protocol,
-			state:       conn.State,
-			destination: d,
-			direction:   direction,
+		if d, translated, direction, ok := connDestinations(conn, isNodeIP); ok {
+			c.accumulate(counts, "", conn, d, translated, direction, now)
+		} else if c.opts.Forwarded && len(matches) == 0 && c.isForwarded(conn, netnsAddresses) {
+			translatedIP, translatedPort := conn.TranslatedDestination()
+			icmp := conn.ICMP()
+			c.accumulate(counts, "", conn, destination{conn.DestIP, conn.DestPort, icmp}, destination{translatedIP, translatedPort, icmp}, ForwardedConnection, now)
 		}
-		counts[key] = counts[key] + 1
 
-		c.trafficCounter.Inc(connTrafficKey{IP: d.ip, Port: d.port}, conn.ID, conn.OriginBytes, conn.ReplyBytes, now)
+		if conn.Closed {
+			c.trafficCounter.Forget(conn.ID)
+		}
 	}
 
+	if c.sourcePorts != nil {
+		c.sourcePorts.Unlock()
+	}
+	if c.cardinality != nil {
+		c.cardinality.clean(now)
+		c.cardinality.Unlock()
+	}
+	if c.dnsHealth != nil {
+		c.dnsHealth.end(cpuStats, cpuStatsErr)
+		c.dnsHealth.Unlock()
+	}
+	if c.attempts != nil {
+		c.attempts.clean(now)
+		c.attempts.Unlock()
+	}
+	if c.connAges != nil {
+		c.connAges.end(now)
+		c.connAges.Unlock()
+	}
 	c.trafficCounter.Unlock()
 
 	for accumulatorKey := range counts {
 		c.lastUsedWorkloadTuples.Store(accumulatorKey, now)
 	}
 
-	c.sendMetrics(counts, workloadMap, ch)
+	return counts, workloadMap, nil
+}
+
+// accumulate counts conn on the gauges and traffic counters of workloadName,
+// an empty workloadName accumulates on the node metrics.
+func (c *ConntrackCollector) accumulate(counts map[accumulatorKey]int, workloadName string, conn *Conn, d, translated destination, direction ConnDirection, now time.Time) {
+	if c.cardinality != nil {
+		d, translated = c.cardinality.admit(workloadName, d, translated, now)
+	}
+	zone, mark, connlabels := c.connDimensions(conn)
+	source := c.connSource(conn, direction)
+	key := accumulatorKey{
+		workload:              workloadName,
+		protocol:              conn.Protocol,
+		state:                 conn.State,
+		destination:           d,
+		translatedDestination: translated,
+		direction:             direction,
+		family:                conn.Family,
+		status:                conn.StatusName(),
+		zone:                  zone,
+		mark:                  mark,
+		connlabels:            connlabels,
+		source:                source,
+	}
+	if c.cardinality != nil && conn.Closed {
+		d, translated = c.cardinality.admitClosed(workloadName, d, translated)
+	} else if c.cardinality != nil {
+		key = c.cardinality.admitSeries(key, now)
+		d, translated = key.destination, key.translatedDestination
+	}
+	if c.sourcePorts != nil {
+		c.sourcePorts.track(workloadName, conn, translated, direction)
+	}
+	if !conn.Closed {
+		counts[key] = counts[key] + 1
+	}
+
+	trafficKey := connTrafficKey{Workload: workloadName, IP: d.ip, Port: d.port, ICMP: d.icmp, TranslatedIP: translated.ip, TranslatedPort: translated.port, Family: conn.Family, Zone: zone, Mark: mark, Connlabels: connlabels, Source: source}
+	c.trafficCounter.Inc(trafficKey, conn.ID, conn.OriginBytes, conn.ReplyBytes, conn.OriginPackets, conn.ReplyPackets, now)
+	if workloadName != "" {
+		if c.connAges != nil {
+			c.connAges.track(trafficKey, conn, now)
+		}
+		if c.attempts != nil && conn.AttemptResult != "" && direction == OutgoingConnection {
+			c.attempts.Inc(attemptKey{connTrafficKey: trafficKey, Protocol: conn.Protocol, Result: conn.AttemptResult}, now)
+		}
+		if c.dnsHealth != nil && direction == OutgoingConnection {
+			c.dnsHealth.track(workloadName, conn, d, translated)
+		}
+	}
+}
+
+// netnsConns dumps the conntrack table of each workload network namespace,
+// workloads without a known namespace or whose dump fails are attributed
+// from the node table.
+func (c *ConntrackCollector) netnsConns(workloads []*workload.Workload) map[string][]*Conn {
+	netnsConns := map[string][]*Conn{}
+	if c.opts.NetNSConntrack == nil {
+		return netnsConns
+	}
+
+	for _, workload := range workloads {
+		netns := workload.NetNSPath(c.opts.ProcPath)
+		if netns == "" {
+			continue
+		}
+		conns, err := c.opts.NetNSConntrack(netns)
+		if err != nil {
+			log.Printf("Could not dump conntrack of workload %s, err: %s", workload.Name, err.Error())
+			continue
+		}
+		netnsConns[workload.Name] = conns
+	}
+	return netnsConns
+}
+
+// connDimensions returns the zone, mark and connlabels of conn used to split
+// metrics, they are zeroed when the respective label is disabled.
+func (c *ConntrackCollector) connDimensions(conn *Conn) (zone uint16, mark uint32, connlabels string) {
+	if c.opts.ZoneLabel {
+		zone = conn.Zone
+	}
+	if c.opts.MarkLabel {
+		mark = conn.Mark
+	}
+	if c.opts.ConnlabelsLabel {
+		connlabels = conn.Labels
+	}
+	return zone, mark, connlabels
+}
+
+// connSource returns the origin of conn used to split metrics, it is empty
+// for outgoing connections and when the source label is disabled.
+func (c *ConntrackCollector) connSource(conn *Conn, direction ConnDirection) connSource {
+	if !c.opts.SourceLabel || direction == OutgoingConnection {
+		return connSource{}
+	}
+	if c.opts.SourceClasses {
+		c.cidrClassifierMutex.Lock()
+		defer c.cidrClassifierMutex.Unlock()
+		return connSource{zone: c.cidrClassifier.Classify(conn.OriginIP)}
+	}
+	return connSource{ip: conn.OriginIP}
+}
+
+func (c *ConntrackCollector) dimensionValues(zone uint16, mark uint32, connlabels, ip, translatedIP string, source connSource) []string {
+	values := []string{}
+	if c.opts.ZoneLabel {
+		values = append(values, strconv.Itoa(int(zone)))
+	}
+	if c.opts.MarkLabel {
+		if class, ok := c.opts.MarkClasses[mark]; ok {
+			values = append(values, class)
+		} else {
+			values = append(values, strconv.FormatUint(uint64(mark), 10))
+		}
+	}
+	if c.opts.ConnlabelsLabel {
+		values = append(values, c.connlabelsValue(connlabels))
+	}
+	if c.opts.DestinationWorkloadLabel {
+		values = append(values, c.destinationWorkloadValues(ip, translatedIP)...)
+	}
+	if c.opts.SourceLabel {
+		if source.ip == "" {
+			values = append(values, "", "", source.zone)
+		} else {
+			name, zone := c.destinationNames(source.ip)
+			values = append(values, source.ip, name, zone)
+		}
+	}
+	return values
+}
+
+// connlabelsValue replaces the connlabel bits found in ConnlabelNames by
+// their names.
+func (c *ConntrackCollector) connlabelsValue(connlabels string) string {
+	if connlabels == "" || len(c.opts.ConnlabelNames) == 0 {
+		return connlabels
+	}
+	bits := strings.Split(connlabels, ",")
+	for i, bit := range bits {
+		n, _ := strconv.Atoi(bit)
+		if name, ok := c.opts.ConnlabelNames[n]; ok {
+			bits[i] = name
+		}
+	}
+	return strings.Join(bits, ",")
+}
+
+// destinationWorkloadValues returns the name and labels of the workload that
+// owns the destination, the translated IP is looked up first since the
+// original one is usually a service address.
+func (c *ConntrackCollector) destinationWorkloadValues(ip, translatedIP string) []string {
+	values := make([]string, 1+len(c.workloadLabels))
+	w := c.addressWorkloads[translatedIP]
+	if w == nil {
+		w = c.addressWorkloads[ip]
+	}
+	if w == nil {
+		return values
+	}
+
+	values[0] = w.Name
+	for i, k := range c.workloadLabels {
+		values[i+1] = w.Labels[k]
+	}
+	return values
+}
+
+// indexAddressWorkloads maps the addresses of workloads to them, addresses
+// shared by many workloads (ie: host network) are not attributed to any.
+func indexAddressWorkloads(workloads map[string]*workload.Workload) map[string]*workload.Workload {
+	addressWorkloads := map[string]*workload.Workload{}
+	for _, w := range workloads {
+		for _, ip := range w.Addresses() {
+			if ip == "" {
+				continue
+			}
+			if other, ok := addressWorkloads[ip]; ok && other != w {
+				addressWorkloads[ip] = nil
+				continue
+			}
+			addressWorkloads[ip] = w
+		}
+	}
+	return addressWorkloads
 }
 
 func (c *ConntrackCollector) metricCleaner() {
@@ -236,13 +699,13 @@ func (c *ConntrackCollector) performMetricCleaner() {
 }
 
 func (c *ConntrackCollector) nodeConnectionsDesc() *prometheus.Desc {
-	return prometheus.NewDesc("conntrack_node_connections", "Number of outbound node connections by destination and state", connectionLabels, nil)
+	return prometheus.NewDesc("conntrack_node_connections", "Number of outbound node connections by destination and state", c.connectionLabels, nil)
 }
 
 func (c *ConntrackCollector) workloadConnectionsDesc() *prometheus.Desc {
 	labels := []string{}
 	labels = append(labels, c.sanitizedWorkloadLabels...)
-	labels = append(labels, connectionLabels...)
+	labels = append(labels, c.connectionLabels...)
 
 	return prometheus.NewDesc("conntrack_workload_connections", "Number of outbound worload connections by destination and state", labels, nil)
 }
@@ -250,30 +713,98 @@ func (c *ConntrackCollector) workloadConnectionsDesc() *prometheus.Desc {
 func (c *ConntrackCollector) workloadOriginBytesTotalDesc() *prometheus.Desc {
 	labels := []string{}
 	labels = append(labels, c.sanitizedWorkloadLabels...)
-	labels = append(labels, originBytesLabels...)
+	labels = append(labels, c.trafficLabels...)
 
 	return prometheus.NewDesc("conntrack_workload_origin_bytes_total", "Number of origin bytes", labels, nil)
 }
 
 func (c *ConntrackCollector) nodeOriginBytesTotalDesc() *prometheus.Desc {
-	return prometheus.NewDesc("conntrack_node_origin_bytes_total", "Number of origin bytes", originBytesLabels, nil)
+	return prometheus.NewDesc("conntrack_node_origin_bytes_total", "Number of origin bytes", c.trafficLabels, nil)
 }
 
 func (c *ConntrackCollector) workloadReplyBytesTotalDesc() *prometheus.Desc {
 	labels := []string{}
 	labels = append(labels, c.sanitizedWorkloadLabels...)
-	labels = append(labels, originBytesLabels...)
+	labels = append(labels, c.trafficLabels...)
 
 	return prometheus.NewDesc("conntrack_workload_reply_bytes_total", "Number of reply bytes", labels, nil)
 }
 
 func (c *ConntrackCollector) nodeReplyBytesTotalDesc() *prometheus.Desc {
-	return prometheus.NewDesc("conntrack_node_reply_bytes_total", "Number of reply bytes", originBytesLabels, nil)
+	return prometheus.NewDesc("conntrack_node_reply_bytes_total", "Number of reply bytes", c.trafficLabels, nil)
+}
+
+func (c *ConntrackCollector) workloadOriginPacketsTotalDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, c.trafficLabels...)
+
+	return prometheus.NewDesc("conntrack_workload_origin_packets_total", "Number of origin packets", labels, nil)
+}
+
+func (c *ConntrackCollector) nodeOriginPacketsTotalDesc() *prometheus.Desc {
+	return prometheus.NewDesc("conntrack_node_origin_packets_total", "Number of origin packets", c.trafficLabels, nil)
+}
+
+func (c *ConntrackCollector) workloadReplyPacketsTotalDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, c.trafficLabels...)
+
+	return prometheus.NewDesc("conntrack_workload_reply_packets_total", "Number of reply packets", labels, nil)
+}
+
+func (c *ConntrackCollector) nodeReplyPacketsTotalDesc() *prometheus.Desc {
+	return prometheus.NewDesc("conntrack_node_reply_packets_total", "Number of reply packets", c.trafficLabels, nil)
+}
+
+func (c *ConntrackCollector) workloadConnectionAgeDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, c.trafficLabels...)
+
+	return prometheus.NewDesc("conntrack_workload_connection_age_seconds", "Age of the open workload connections, observed on every scrape", labels, nil)
+}
+
+func (c *ConntrackCollector) workloadConnectionLifetimeDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, c.trafficLabels...)
+
+	return prometheus.NewDesc("conntrack_workload_connection_lifetime_seconds", "Lifetime of the closed workload connections", labels, nil)
+}
+
+func (c *ConntrackCollector) workloadSynSentOldestDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, c.trafficLabels...)
+
+	return prometheus.NewDesc("conntrack_workload_syn_sent_oldest_seconds", "Age of the oldest workload connection stuck on SYN-SENT", labels, nil)
+}
+
+func (c *ConntrackCollector) workloadSynSentAgeDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, c.trafficLabels...)
+
+	return prometheus.NewDesc("conntrack_workload_syn_sent_age_seconds", "Age of the workload connections stuck on SYN-SENT, observed on every scrape", labels, nil)
+}
+
+func (c *ConntrackCollector) workloadConnectionAttemptsDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, c.trafficLabels...)
+	labels = append(labels, "protocol", "result")
+
+	return prometheus.NewDesc("conntrack_workload_connection_attempts_total", "Number of outgoing workload connections by result, counted when they are closed", labels, nil)
 }
 
 func (c *ConntrackCollector) sendMetrics(counts map[accumulatorKey]int, workloads map[string]*workload.Workload, ch chan<- prometheus.Metric) {
 	c.cidrClassifierMutex.Lock()
 	defer c.cidrClassifierMutex.Unlock()
+	if c.opts.DestinationWorkloadLabel {
+		c.addressWorkloads = indexAddressWorkloads(workloads)
+	}
 
 	workloadConnectionsDesc := c.workloadConnectionsDesc()
 	nodeConnectionsDesc := c.nodeConnectionsDesc()
@@ -296,12 +827,13 @@ func (c *ConntrackCollector) sendMetrics(counts map[accumulatorKey]int, workload
 		values[i] = accumulator.state
 		values[i+1] = accumulator.protocol
 		values[i+2] = accumulator.destination.String()
-		if accumulator.destination.ip != "" {
-			values[i+3] = c.dnsCache.ResolveIP(accumulator.destination.ip)
-			values[i+4] = c.cidrClassifier.Classify(accumulator.destination.ip)
-		}
+		values[i+3], values[i+4] = c.destinationNames(accumulator.destination.ip)
 
 		values[i+5] = string(accumulator.direction)
+		values[i+6] = accumulator.family
+		values[i+7] = accumulator.translatedDestination.String()
+		values[i+8] = accumulator.status
+		copy(values[i+9:], c.dimensionValues(accumulator.zone, accumulator.mark, accumulator.connlabels, accumulator.destination.ip, accumulator.translatedDestination.ip, accumulator.source))
 		ch <- prometheus.MustNewConstMetric(workloadConnectionsDesc, prometheus.GaugeValue, float64(count), values...)
 		return true
 	})
@@ -320,12 +852,12 @@ func (c *ConntrackCollector) sendMetrics(counts map[accumulatorKey]int, workload
 			"",
 			"",
 			string(accumulator.direction),
+			accumulator.family,
+			accumulator.translatedDestination.String(),
+			accumulator.status,
 		}
-
-		if accumulator.destination.ip != "" {
-			values[3] = c.dnsCache.ResolveIP(accumulator.destination.ip)
-			values[4] = c.cidrClassifier.Classify(accumulator.destination.ip)
-		}
+		values = append(values, c.dimensionValues(accumulator.zone, accumulator.mark, accumulator.connlabels, accumulator.destination.ip, accumulator.translatedDestination.ip, accumulator.source)...)
+		values[3], values[4] = c.destinationNames(accumulator.destination.ip)
 		ch <- prometheus.MustNewConstMetric(nodeConnectionsDesc, prometheus.GaugeValue, float64(count), values...)
 		return true
 	})
@@ -335,8 +867,11 @@ func (c *ConntrackCollector) sendMetrics(counts map[accumulatorKey]int, workload
 
 	trafficBytesItems := c.trafficCounter.List()
 
-	// workloads origin
+	// workloads origin and reply
 	workloadOriginBytesLabelDesc := c.workloadOriginBytesTotalDesc()
+	replyBytesTotalDesc := c.workloadReplyBytesTotalDesc()
+	workloadOriginPacketsDesc := c.workloadOriginPacketsTotalDesc()
+	workloadReplyPacketsDesc := c.workloadReplyPacketsTotalDesc()
 	for _, trafficBytesItem := range trafficBytesItems {
 		workload := workloads[trafficBytesItem.Workload]
 
@@ -344,44 +879,98 @@ func (c *ConntrackCollector) sendMetrics(counts map[accumulatorKey]int, workload
 			continue
 		}
 
-		ch <- prometheus.MustNewConstMetric(workloadOriginBytesLabelDesc, prometheus.CounterValue, float64(trafficBytesItem.OriginCounter), c.workloadBytesLabels(workload, trafficBytesItem.connTrafficKey)...)
+		values := c.workloadBytesLabels(workload, trafficBytesItem.connTrafficKey)
+		ch <- prometheus.MustNewConstMetric(workloadOriginBytesLabelDesc, prometheus.CounterValue, float64(trafficBytesItem.OriginCounter), values...)
+		ch <- prometheus.MustNewConstMetric(replyBytesTotalDesc, prometheus.CounterValue, float64(trafficBytesItem.ReplyCounter), values...)
+		ch <- prometheus.MustNewConstMetric(workloadOriginPacketsDesc, prometheus.CounterValue, float64(trafficBytesItem.OriginPackets), values...)
+		ch <- prometheus.MustNewConstMetric(workloadReplyPacketsDesc, prometheus.CounterValue, float64(trafficBytesItem.ReplyPackets), values...)
 	}
 
-	// nodes origin
+	// nodes origin and reply
 	nodeOriginBytesLabelDesc := c.nodeOriginBytesTotalDesc()
+	nodeReplyBytesTotalDesc := c.nodeReplyBytesTotalDesc()
+	nodeOriginPacketsDesc := c.nodeOriginPacketsTotalDesc()
+	nodeReplyPacketsDesc := c.nodeReplyPacketsTotalDesc()
 	for _, trafficBytesItem := range trafficBytesItems {
 		if trafficBytesItem.Workload != "" {
 			continue
 		}
 
-		ch <- prometheus.MustNewConstMetric(nodeOriginBytesLabelDesc, prometheus.CounterValue, float64(trafficBytesItem.OriginCounter), c.destinationLabels(trafficBytesItem.connTrafficKey)...)
+		values := c.destinationLabels(trafficBytesItem.connTrafficKey)
+		ch <- prometheus.MustNewConstMetric(nodeOriginBytesLabelDesc, prometheus.CounterValue, float64(trafficBytesItem.OriginCounter), values...)
+		ch <- prometheus.MustNewConstMetric(nodeReplyBytesTotalDesc, prometheus.CounterValue, float64(trafficBytesItem.ReplyCounter), values...)
+		ch <- prometheus.MustNewConstMetric(nodeOriginPacketsDesc, prometheus.CounterValue, float64(trafficBytesItem.OriginPackets), values...)
+		ch <- prometheus.MustNewConstMetric(nodeReplyPacketsDesc, prometheus.CounterValue, float64(trafficBytesItem.ReplyPackets), values...)
 	}
 
-	// workload reply
-	replyBytesTotalDesc := c.workloadReplyBytesTotalDesc()
-	for _, trafficBytesItem := range trafficBytesItems {
-		workload := workloads[trafficBytesItem.Workload]
+	if c.attempts != nil {
+		c.attempts.Lock()
+		connectionAttemptsDesc := c.workloadConnectionAttemptsDesc()
+		for key, value := range c.attempts.m {
+			if workload := workloads[key.Workload]; workload != nil {
+				values := append(c.workloadBytesLabels(workload, key.connTrafficKey), key.Protocol, key.Result)
+				ch <- prometheus.MustNewConstMetric(connectionAttemptsDesc, prometheus.CounterValue, float64(value.Count), values...)
+			}
+		}
+		c.attempts.Unlock()
+	}
 
-		if workload == nil {
-			continue
+	if c.connAges != nil {
+		c.sendConnectionAgeMetrics(workloads, ch)
+	}
+
+	if c.dnsHealth != nil {
+		c.sendDNSHealthMetrics(workloads, ch)
+	}
+
+	if c.sourcePorts != nil {
+		c.sendSourcePortsMetrics(workloads, ch)
+	}
+
+	if c.cardinality != nil {
+		c.cardinality.Lock()
+		for reason, dropped := range c.cardinality.dropped {
+			ch <- prometheus.MustNewConstMetric(droppedSeriesDesc, prometheus.CounterValue, float64(dropped), reason)
 		}
+		c.cardinality.Unlock()
+	}
+}
+
+func (c *ConntrackCollector) sendConnectionAgeMetrics(workloads map[string]*workload.Workload, ch chan<- prometheus.Metric) {
+	c.connAges.Lock()
+	defer c.connAges.Unlock()
 
-		ch <- prometheus.MustNewConstMetric(replyBytesTotalDesc, prometheus.CounterValue, float64(trafficBytesItem.ReplyCounter), c.workloadBytesLabels(workload, trafficBytesItem.connTrafficKey)...)
+	connectionAgeDesc := c.workloadConnectionAgeDesc()
+	for key, h := range c.connAges.ages {
+		if workload := workloads[key.Workload]; workload != nil {
+			ch <- h.metric(connectionAgeDesc, c.workloadBytesLabels(workload, key))
+		}
 	}
 
-	// node reply
-	nodeReplyBytesTotalDesc := c.nodeReplyBytesTotalDesc()
-	for _, trafficBytesItem := range trafficBytesItems {
-		if trafficBytesItem.Workload != "" {
-			continue
+	connectionLifetimeDesc := c.workloadConnectionLifetimeDesc()
+	for key, h := range c.connAges.lifetimes {
+		if workload := workloads[key.Workload]; workload != nil {
+			ch <- h.metric(connectionLifetimeDesc, c.workloadBytesLabels(workload, key))
 		}
+	}
 
-		ch <- prometheus.MustNewConstMetric(nodeReplyBytesTotalDesc, prometheus.CounterValue, float64(trafficBytesItem.ReplyCounter), c.destinationLabels(trafficBytesItem.connTrafficKey)...)
+	synSentAgeDesc := c.workloadSynSentAgeDesc()
+	for key, h := range c.connAges.synSentAges {
+		if workload := workloads[key.Workload]; workload != nil {
+			ch <- h.metric(synSentAgeDesc, c.workloadBytesLabels(workload, key))
+		}
+	}
+
+	synSentOldestDesc := c.workloadSynSentOldestDesc()
+	for key, oldest := range c.connAges.synSentOldest {
+		if workload := workloads[key.Workload]; workload != nil {
+			ch <- prometheus.MustNewConstMetric(synSentOldestDesc, prometheus.GaugeValue, oldest.Seconds(), c.workloadBytesLabels(workload, key)...)
+		}
 	}
 }
 
 func (c *ConntrackCollector) workloadBytesLabels(workload *workload.Workload, destination connTrafficKey) []string {
-	values := make([]string, len(c.workloadLabels)+4)
+	values := make([]string, 1+len(c.workloadLabels)+len(c.trafficLabels))
 	values[0] = workload.Name
 	i := 1
 	for _, k := range c.workloadLabels {
@@ -389,13 +978,10 @@ func (c *ConntrackCollector) workloadBytesLabels(workload *workload.Workload, de
 		i++
 	}
 	values[i] = destination.DestinationString()
-	if destination.IP == "" {
-		values[i+1] = ""
-		values[i+2] = ""
-	} else {
-		values[i+1] = c.dnsCache.ResolveIP(destination.IP)
-		values[i+2] = c.cidrClassifier.Classify(destination.IP)
-	}
+	values[i+1], values[i+2] = c.destinationNames(destination.IP)
+	values[i+3] = destination.Family
+	values[i+4] = destination.TranslatedDestinationString()
+	copy(values[i+5:], c.dimensionValues(destination.Zone, destination.Mark, destination.Connlabels, destination.IP, destination.TranslatedIP, destination.Source))
 
 	return values
 }
@@ -405,17 +991,54 @@ func (c *ConntrackCollector) destinationLabels(destination connTrafficKey) []str
 		destination.DestinationString(),
 		"",
 		"",
+		destination.Family,
+		destination.TranslatedDestinationString(),
 	}
+	values = append(values, c.dimensionValues(destination.Zone, destination.Mark, destination.Connlabels, destination.IP, destination.TranslatedIP, destination.Source)...)
+	values[1], values[2] = c.destinationNames(destination.IP)
 
-	if destination.IP != "" {
-		values[1] = c.dnsCache.ResolveIP(destination.IP)
-		values[2] = c.cidrClassifier.Classify(destination.IP)
+	return values
+}
+
+// destinationNames returns the destination_name and destination_zone of ip,
+// which are empty for incoming connections and the overflow destination.
+func (c *ConntrackCollector) destinationNames(ip string) (name, zone string) {
+	if ip == "" || ip == overflowDestination {
+		return "", ""
 	}
+	return c.dnsCache.ResolveIP(ip), c.cidrClassifier.Classify(ip)
+}
 
-	return values
+// isForwarded tells whether conn only passes through the node, none of its
+// addresses is local. Workloads and node IPs are matched before.
+func (c *ConntrackCollector) isForwarded(conn *Conn, netnsAddresses map[string]struct{}) bool {
+	translatedIP, _ := conn.TranslatedDestination()
+	for _, ip := range []string{conn.OriginIP, conn.DestIP, translatedIP} {
+		if skipIp(ip) {
+			return false
+		}
+		if _, ok := c.localIPs[ip]; ok {
+			return false
+		}
+		if _, ok := netnsAddresses[ip]; ok {
+			return false
+		}
+	}
+	return true
 }
 
 func nodeIPs() (map[string]struct{}, error) {
+	return interfaceIPs(func(iface, ip string) bool {
+		return skipIface(iface) || skipIp(ip)
+	})
+}
+
+// localIPs returns every address of the node interfaces
+func localIPs() (map[string]struct{}, error) {
+	return interfaceIPs(func(iface, ip string) bool { return false })
+}
+
+func interfaceIPs(skip func(iface, ip string) bool) (map[string]struct{}, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
@@ -424,9 +1047,6 @@ func nodeIPs() (map[string]struct{}, error) {
 	result := map[string]struct{}{}
 
 	for _, iface := range interfaces {
-		if skipIface(iface.Name) {
-			continue
-		}
 		addrs, err := iface.Addrs()
 		if err != nil {
 			return nil, err
@@ -435,7 +1055,7 @@ func nodeIPs() (map[string]struct{}, error) {
 		for _, addr := range addrs {
 			ip := strings.Split(addr.String(), "/")[0]
 
-			if !skipIp(ip) {
+			if !skip(iface.Name, ip) {
 				result[ip] = struct{}{}
 			}
 		}
@@ -444,10 +1064,14 @@ func nodeIPs() (map[string]struct{}, error) {
 	return result, nil
 }
 
-var denyListNodeIPs = map[string]bool{"127.0.0.1": true, "::1": true}
-
+// skipIp ignores loopback and link-local addresses (169.254.0.0/16 and fe80::/10)
 func skipIp(ip string) bool {
-	return denyListNodeIPs[ip] || strings.HasPrefix(ip, "169.254")
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return true
+	}
+
+	return parsedIP.IsLoopback() || parsedIP.IsLinkLocalUnicast()
 }
 
 func skipIface(name string) bool {
@@ -5,6 +5,8 @@
 package collector
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sort"
@@ -12,6 +14,7 @@ import (
 	"testing"
 	"time"
 
+	ct "github.com/florianl/go-conntrack"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
@@ -48,14 +51,16 @@ func TestCollector(t *testing.T) {
 	conntrack := &fakeConntrack{
 		conns: [][]*Conn{
 			{
-				{OriginIP: "10.100.1.2", OriginPort: 33404, DestIP: "192.165.50.4", DestPort: 443, State: "ESTABLISHED", Protocol: "tcp"},
-				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, State: "ESTABLISHED", Protocol: "tcp"},
-				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, State: "ESTABLISHED", Protocol: "tcp"},
-				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.5", DestPort: 2376, State: "ESTABLISHED", Protocol: "tcp"},
-				{OriginIP: "192.168.50.5", OriginPort: 33404, DestIP: "10.10.1.2", DestPort: 7070, State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "10.100.1.2", OriginPort: 33404, DestIP: "192.165.50.4", DestPort: 443, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.5", DestPort: 2376, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "192.168.50.5", OriginPort: 33404, DestIP: "10.10.1.2", DestPort: 7070, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "fd00:10:10::2", OriginPort: 33404, DestIP: "fd00:192:168::4", DestPort: 443, Family: "ipv6", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "fd00:192:168::5", OriginPort: 33404, DestIP: "fd00:10:10::2", DestPort: 7070, Family: "ipv6", State: "ESTABLISHED", Protocol: "tcp"},
 			},
 			{
-				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
 			},
 		},
 	}
@@ -65,12 +70,13 @@ func TestCollector(t *testing.T) {
 
 	collector, _ := New(
 		workloadTesting.New("containerd", "container", []*workload.Workload{
-			{Name: "my-container1", IP: "10.10.1.2", Labels: map[string]string{"label1": "val1", "app": "app1"}},
+			{Name: "my-container1", IP: "10.10.1.2", IPs: []string{"10.10.1.2", "fd00:10:10::2"}, Labels: map[string]string{"label1": "val1", "app": "app1"}},
 		}),
 		conntrack.conntrack,
 		[]string{"app"},
 		&fakeDNSCache{},
 		classifier,
+		Opts{},
 	)
 	prometheus.MustRegister(collector)
 	rr := httptest.NewRecorder()
@@ -79,9 +85,12 @@ func TestCollector(t *testing.T) {
 	promhttp.Handler().ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusOK, rr.Code)
 	lines := strings.Split(rr.Body.String(), "\n")
-	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",label_app="app1",protocol="tcp",state="ESTABLISHED"} 2`)
-	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.5:2376",destination_name="bob-service",destination_zone="",direction="outgoing",label_app="app1",protocol="tcp",state="ESTABLISHED"} 1`)
-	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination=":7070",destination_name="",destination_zone="",direction="incoming",label_app="app1",protocol="tcp",state="ESTABLISHED"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",label_app="app1",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.5:2376",destination_name="bob-service",destination_zone="",direction="outgoing",ip_family="ipv4",label_app="app1",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.5:2376"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination=":7070",destination_name="",destination_zone="",direction="incoming",ip_family="ipv4",label_app="app1",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination=":7070"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="[fd00:192:168::4]:443",destination_name="",destination_zone="",direction="outgoing",ip_family="ipv6",label_app="app1",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="[fd00:192:168::4]:443"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination=":7070",destination_name="",destination_zone="",direction="incoming",ip_family="ipv6",label_app="app1",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination=":7070"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="[fd00:192:168::4]:443",destination_name="",destination_zone="",ip_family="ipv6",label_app="app1",translated_destination="[fd00:192:168::4]:443"} 0`)
 
 	req, err = http.NewRequest("GET", "/metrics", nil)
 	require.NoError(t, err)
@@ -89,8 +98,544 @@ func TestCollector(t *testing.T) {
 	promhttp.Handler().ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusOK, rr.Code)
 	lines = strings.Split(rr.Body.String(), "\n")
-	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",label_app="app1",protocol="tcp",state="ESTABLISHED"} 1`)
-	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.5:2376",destination_name="bob-service",destination_zone="",direction="outgoing",label_app="app1",protocol="tcp",state="ESTABLISHED"} 0`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",label_app="app1",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.5:2376",destination_name="bob-service",destination_zone="",direction="outgoing",ip_family="ipv4",label_app="app1",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.5:2376"} 0`)
+}
+
+func scrape(t *testing.T, collector prometheus.Collector) []string {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	require.NoError(t, err)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	return strings.Split(rr.Body.String(), "\n")
+}
+
+func newTestCollector(t *testing.T, conntrack Conntrack, workloads []*workload.Workload, workloadLabels []string, classes map[string]string, opts Opts) *ConntrackCollector {
+	t.Helper()
+	classifier, err := NewCIDRClassifier(classes)
+	require.NoError(t, err)
+
+	collector, err := New(workloadTesting.New("containerd", "container", workloads), conntrack, workloadLabels, &fakeDNSCache{}, classifier, opts)
+	require.NoError(t, err)
+	return collector
+}
+
+func TestCollectorClosedConnections(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", OriginBytes: 100, ReplyBytes: 1000, OriginPackets: 2, ReplyPackets: 3},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "CLOSED", Protocol: "tcp", OriginBytes: 50, ReplyBytes: 500, OriginPackets: 1, ReplyPackets: 1, Closed: true},
+			},
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "CLOSED", Protocol: "tcp", OriginBytes: 110, ReplyBytes: 1100, OriginPackets: 4, ReplyPackets: 5, Closed: true},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 150`)
+	assert.Contains(t, lines, `conntrack_workload_reply_bytes_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 1500`)
+	assert.Contains(t, lines, `conntrack_workload_origin_packets_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 3`)
+	assert.Contains(t, lines, `conntrack_workload_reply_packets_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 4`)
+	for _, line := range lines {
+		assert.NotContains(t, line, `state="CLOSED"`)
+	}
+
+	lines = scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 0`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 160`)
+	assert.Contains(t, lines, `conntrack_workload_reply_bytes_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 1600`)
+	assert.Contains(t, lines, `conntrack_workload_origin_packets_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 5`)
+	assert.Contains(t, lines, `conntrack_workload_reply_packets_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 6`)
+	collector.trafficCounter.RLock()
+	assert.Empty(t, collector.trafficCounter.previousConnState)
+	collector.trafficCounter.RUnlock()
+	for _, line := range lines {
+		assert.False(t, strings.HasPrefix(line, "conntrack_workload_connection_attempts_total"), line)
+	}
+}
+
+func TestCollectorDestinations(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "10.96.0.10", DestPort: 53, ReplyOriginIP: "10.10.1.9", ReplyOriginPort: 5353, ReplyDestIP: "10.10.1.2", ReplyDestPort: 33404, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "192.168.50.5", OriginPort: 33404, DestIP: "10.0.0.1", DestPort: 30080, ReplyOriginIP: "10.10.1.3", ReplyOriginPort: 8080, ReplyDestIP: "192.168.50.5", ReplyDestPort: 33404, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "10.10.1.2", DestIP: "192.168.50.4", Family: "ipv4", State: "OPEN", Protocol: "ICMP", IcmpType: 8},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+		{Name: "my-container2", IP: "10.10.1.3"},
+	}, []string{}, map[string]string{}, Opts{})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="10.96.0.10:53",destination_name="",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="10.10.1.9:5353"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container2",destination=":30080",destination_name="",destination_zone="",direction="incoming",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination=":8080"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="10.96.0.10:53",destination_name="",destination_zone="",ip_family="ipv4",translated_destination="10.10.1.9:5353"} 0`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4 type=8 code=0",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="ICMP",state="OPEN",status="unreplied",translated_destination="192.168.50.4 type=8 code=0"} 1`)
+}
+
+func TestCollectorZonesAndMarks(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Zone: 1, Mark: 1, OriginBytes: 10},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Zone: 1, Mark: 1, OriginBytes: 20},
+				{ID: 3, OriginIP: "10.10.1.2", OriginPort: 33406, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Mark: 7},
+				{ID: 4, OriginIP: "10.0.0.1", OriginPort: 33406, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Zone: 2},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{ZoneLabel: true, MarkLabel: true, MarkClasses: map[uint32]string{1: "egress-proxy"}})
+	collector.nodeIPs = map[string]struct{}{"10.0.0.1": {}}
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",mark="egress-proxy",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375",zone="1"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",mark="7",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375",zone="0"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",mark="egress-proxy",translated_destination="192.168.50.4:2375",zone="1"} 30`)
+	assert.Contains(t, lines, `conntrack_node_connections{destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",mark="0",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375",zone="2"} 1`)
+}
+
+func TestCollectorConnlabels(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Labels: "1,5", OriginBytes: 10},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Labels: "1,5", OriginBytes: 20},
+				{ID: 3, OriginIP: "10.10.1.2", OriginPort: 33406, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{ConnlabelsLabel: true, ConnlabelNames: map[int]string{1: "egress-proxy"}})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{connlabels="egress-proxy,5",container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_connections{connlabels="",container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{connlabels="egress-proxy,5",container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 30`)
+}
+
+func TestCollectorNetNS(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+				{OriginIP: "10.10.1.3", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+			},
+		},
+	}
+	netnsConns := map[string][]*Conn{
+		"/proc/42/ns/net": {
+			{OriginIP: "127.0.0.1", OriginPort: 33404, DestIP: "192.168.50.5", DestPort: 2376, ReplyOriginIP: "127.0.0.1", ReplyOriginPort: 15001, ReplyDestIP: "127.0.0.1", ReplyDestPort: 33404, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+			{OriginIP: "192.168.50.6", OriginPort: 33404, DestIP: "10.10.1.2", DestPort: 8080, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp"},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2", PID: 42},
+		{Name: "my-container2", IP: "10.10.1.3", NetNS: "/var/run/netns/unknown"},
+	}, []string{}, map[string]string{}, Opts{NetNSConntrack: func(netns string) ([]*Conn, error) {
+		conns, ok := netnsConns[netns]
+		if !ok {
+			return nil, errors.New("namespace not found")
+		}
+		return conns, nil
+	}})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.5:2376",destination_name="bob-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="127.0.0.1:15001"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination=":8080",destination_name="",destination_zone="",direction="incoming",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination=":8080"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container2",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 1`)
+	for _, line := range lines {
+		assert.False(t, strings.HasPrefix(line, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375"`), line)
+	}
+}
+
+func TestCollectorConnectionAges(t *testing.T) {
+	now := time.Now().UTC()
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Start: now.Add(-10 * time.Minute)},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Start: now.Add(-2 * time.Second)},
+			},
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Start: now.Add(-10 * time.Minute)},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{ConnectionAge: true})
+
+	defer func(grace time.Duration) { closeGrace = grace }(closeGrace)
+	closeGrace = 0
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connection_age_seconds_bucket{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375",le="5"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connection_age_seconds_bucket{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375",le="900"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_connection_age_seconds_count{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 2`)
+
+	lines = scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connection_age_seconds_count{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 3`)
+	assert.Contains(t, lines, `conntrack_workload_connection_lifetime_seconds_bucket{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375",le="5"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connection_lifetime_seconds_count{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 1`)
+	for _, line := range lines {
+		assert.NotContains(t, line, "syn_sent")
+	}
+}
+
+func TestCollectorSynSent(t *testing.T) {
+	now := time.Now().UTC()
+	conns := []*Conn{
+		{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "SYN-SENT", Protocol: "tcp", Start: now.Add(-20 * time.Second)},
+		{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "SYN-SENT", Protocol: "tcp", Start: now.Add(-70 * time.Second)},
+		{ID: 3, OriginIP: "10.10.1.2", OriginPort: 33406, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", Start: now.Add(-time.Hour)},
+	}
+	conntrack := &fakeConntrack{conns: [][]*Conn{conns, conns}}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{SynSent: true})
+
+	lines := scrape(t, collector)
+	assert.Regexp(t, `(?m)^conntrack_workload_syn_sent_oldest_seconds\{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"\} 70(\.\d+)?$`, strings.Join(lines, "\n"))
+	assert.Contains(t, lines, `conntrack_workload_syn_sent_age_seconds_bucket{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375",le="30"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_syn_sent_age_seconds_bucket{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375",le="90"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_syn_sent_age_seconds_count{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 2`)
+
+	// the ages are observed again on every scrape
+	lines = scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_syn_sent_age_seconds_count{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 4`)
+	for _, line := range lines {
+		assert.NotContains(t, line, "conntrack_workload_connection_age_seconds")
+		assert.NotContains(t, line, "conntrack_workload_connection_lifetime_seconds")
+	}
+}
+
+func TestCollectorConnectionAttempts(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "CLOSED", Protocol: "TCP", AttemptResult: AttemptEstablished, Closed: true},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "CLOSED", Protocol: "TCP", AttemptResult: AttemptTimeout, Closed: true},
+				{ID: 3, OriginIP: "10.10.1.2", OriginPort: 33406, DestIP: "10.96.0.10", DestPort: 53, Family: "ipv4", State: "CLOSED", Protocol: "UDP", AttemptResult: AttemptUnreplied, Closed: true},
+				{ID: 4, OriginIP: "192.168.50.4", OriginPort: 33407, DestIP: "10.10.1.2", DestPort: 8080, Family: "ipv4", State: "CLOSED", Protocol: "TCP", AttemptResult: AttemptReset, Closed: true},
+			},
+			{
+				{ID: 5, OriginIP: "10.10.1.2", OriginPort: 33408, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "CLOSED", Protocol: "TCP", AttemptResult: AttemptEstablished, Closed: true},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2", Labels: map[string]string{"app": "app1"}},
+	}, []string{"app"}, map[string]string{}, Opts{ConnectionAttempts: true})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connection_attempts_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",label_app="app1",protocol="TCP",result="established",translated_destination="192.168.50.4:2375"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connection_attempts_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",label_app="app1",protocol="TCP",result="timeout",translated_destination="192.168.50.4:2375"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connection_attempts_total{container="my-container1",destination="10.96.0.10:53",destination_name="",destination_zone="",ip_family="ipv4",label_app="app1",protocol="UDP",result="unreplied",translated_destination="10.96.0.10:53"} 1`)
+	for _, line := range lines {
+		assert.NotContains(t, line, `result="reset"`)
+	}
+
+	lines = scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connection_attempts_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",label_app="app1",protocol="TCP",result="established",translated_destination="192.168.50.4:2375"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_connection_attempts_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",label_app="app1",protocol="TCP",result="timeout",translated_destination="192.168.50.4:2375"} 1`)
+}
+
+func TestCollectorStatus(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{OriginIP: "10.10.1.2", OriginPort: 41234, DestIP: "10.96.0.10", DestPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP", Status: IPS_SEEN_REPLY},
+				{OriginIP: "10.10.1.2", OriginPort: 41235, DestIP: "10.96.0.10", DestPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP"},
+				{OriginIP: "10.10.1.2", OriginPort: 41236, DestIP: "10.96.0.10", DestPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP"},
+				{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", Status: IPS_SEEN_REPLY | IPS_ASSURED},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="10.96.0.10:53",destination_name="",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="UDP",state="OPEN",status="seen_reply",translated_destination="10.96.0.10:53"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="10.96.0.10:53",destination_name="",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="UDP",state="OPEN",status="unreplied",translated_destination="10.96.0.10:53"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="TCP",state="ESTABLISHED",status="assured",translated_destination="192.168.50.4:2375"} 1`)
+}
+
+func TestCollectorDNSHealth(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 41234, DestIP: "10.96.0.10", DestPort: 53, ReplyOriginIP: "10.2.0.5", ReplyOriginPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP", Status: IPS_SEEN_REPLY},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 41235, DestIP: "10.96.0.10", DestPort: 53, ReplyOriginIP: "10.2.0.5", ReplyOriginPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP"},
+				{ID: 3, OriginIP: "10.10.1.2", OriginPort: 41236, DestIP: "10.96.0.10", DestPort: 53, ReplyOriginIP: "10.2.0.6", ReplyOriginPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP"},
+				{ID: 4, OriginIP: "10.10.1.3", OriginPort: 41237, DestIP: "10.96.0.10", DestPort: 53, ReplyOriginIP: "10.2.0.6", ReplyOriginPort: 53, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", Status: IPS_SEEN_REPLY | IPS_ASSURED},
+				{ID: 5, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+			},
+			{
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 41235, DestIP: "10.96.0.10", DestPort: 53, ReplyOriginIP: "10.2.0.5", ReplyOriginPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP"},
+				{ID: 6, OriginIP: "10.10.1.2", OriginPort: 41238, DestIP: "10.96.0.10", DestPort: 53, ReplyOriginIP: "10.2.0.5", ReplyOriginPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP"},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+		{Name: "my-container2", IP: "10.10.1.3"},
+	}, []string{}, map[string]string{}, Opts{DNSHealth: true})
+	insertFailed := uint32(10)
+	collector.dnsHealth.dumpCPUStat = func() ([]ct.CPUStat, error) {
+		return []ct.CPUStat{{ID: 0, InsertFailed: uint32Ptr(insertFailed)}}, nil
+	}
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_dns_flows{container="my-container1",protocol="UDP",resolver="10.96.0.10:53",status="replied",translated_resolver="10.2.0.5:53"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_dns_flows{container="my-container1",protocol="UDP",resolver="10.96.0.10:53",status="unreplied",translated_resolver="10.2.0.5:53"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_dns_flows{container="my-container1",protocol="UDP",resolver="10.96.0.10:53",status="unreplied",translated_resolver="10.2.0.6:53"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_dns_flows{container="my-container2",protocol="TCP",resolver="10.96.0.10:53",status="replied",translated_resolver="10.2.0.6:53"} 1`)
+	assert.Contains(t, lines, `conntrack_dns_resolver_flows{resolver="10.2.0.5:53",status="replied"} 1`)
+	assert.Contains(t, lines, `conntrack_dns_resolver_flows{resolver="10.2.0.5:53",status="unreplied"} 1`)
+	assert.Contains(t, lines, `conntrack_dns_resolver_flows{resolver="10.2.0.6:53",status="replied"} 1`)
+	assert.Contains(t, lines, `conntrack_dns_resolver_flows{resolver="10.2.0.6:53",status="unreplied"} 1`)
+	assert.Contains(t, lines, `conntrack_dns_insert_failed_unreplied_flows_total 0`)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "conntrack_workload_dns_flows") {
+			assert.NotContains(t, line, "192.168.50.4")
+		}
+	}
+
+	// only connection 6 is a new unreplied flow
+	insertFailed = 12
+	lines = scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_dns_flows{container="my-container1",protocol="UDP",resolver="10.96.0.10:53",status="unreplied",translated_resolver="10.2.0.5:53"} 2`)
+	assert.Contains(t, lines, `conntrack_dns_resolver_flows{resolver="10.2.0.5:53",status="unreplied"} 2`)
+	assert.Contains(t, lines, `conntrack_dns_insert_failed_unreplied_flows_total 1`)
+}
+
+func TestCollectorCardinalityLimits(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 5, OriginIP: "10.10.1.2", OriginPort: 33403, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "CLOSED", Protocol: "TCP", OriginBytes: 5, Closed: true},
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 10},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "192.168.50.5", DestPort: 443, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 20},
+				{ID: 3, OriginIP: "10.10.1.2", OriginPort: 33406, DestIP: "192.168.50.6", DestPort: 443, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 30},
+				{ID: 4, OriginIP: "10.10.1.2", OriginPort: 33407, DestIP: "192.168.50.7", DestPort: 443, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 40},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{MaxDestinationsPerWorkload: 2})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.5:443",destination_name="bob-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.5:443"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="other",destination_name="",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination="other"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="other",destination_name="",destination_zone="",ip_family="ipv4",translated_destination="other"} 70`)
+	assert.Contains(t, lines, `conntrack_dropped_series_total{reason="workload_limit"} 2`)
+	for _, line := range lines {
+		assert.NotContains(t, line, "192.168.50.6")
+		assert.NotContains(t, line, "192.168.50.7")
+	}
+
+	conntrack.calls = 0
+	collector = newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{MaxSeries: 3})
+
+	lines = scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="other",destination_name="",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination="other"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 15`)
+	// closed connections don't take series of the limit
+	assert.Contains(t, lines, `conntrack_dropped_series_total{reason="series_limit"} 1`)
+}
+
+func TestCollectorSourcePorts(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+				{ID: 3, OriginIP: "10.10.1.2", OriginPort: 33406, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "TIME-WAIT", Protocol: "TCP"},
+				{ID: 4, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.5", DestPort: 2376, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+				{ID: 5, OriginIP: "192.168.50.5", OriginPort: 33404, DestIP: "10.10.1.2", DestPort: 7070, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+				{ID: 6, OriginIP: "10.10.1.2", OriginPort: 33407, DestIP: "10.96.0.1", DestPort: 80, ReplyOriginIP: "192.168.50.4", ReplyOriginPort: 2375, ReplyDestIP: "10.10.1.2", ReplyDestPort: 33407, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{}, Opts{SourcePorts: true})
+	collector.sourcePorts.sysctl = func(name string) (string, error) {
+		return "60000\t60999", nil
+	}
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_source_ports{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",protocol="TCP"} 4`)
+	assert.Contains(t, lines, `conntrack_workload_source_ports_utilization{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",protocol="TCP"} 0.004`)
+	assert.Contains(t, lines, `conntrack_workload_source_ports{container="my-container1",destination="192.168.50.5:2376",destination_name="bob-service",destination_zone="",ip_family="ipv4",protocol="TCP"} 1`)
+	for _, line := range lines {
+		assert.NotContains(t, line, `source_ports{container="my-container1",destination=":7070"`)
+	}
+}
+
+func TestCollectorDestinationWorkloads(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "10.10.1.3", DestPort: 8080, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 10},
+				{ID: 2, OriginIP: "10.10.1.2", OriginPort: 33405, DestIP: "10.96.0.1", DestPort: 80, ReplyOriginIP: "10.10.1.3", ReplyOriginPort: 8080, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 20},
+				{ID: 3, OriginIP: "10.10.1.2", OriginPort: 33406, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+				{ID: 4, OriginIP: "10.10.1.2", OriginPort: 33407, DestIP: "10.10.1.9", DestPort: 9100, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2", Labels: map[string]string{"app": "app1"}},
+		{Name: "my-container2", IP: "10.10.1.3", Labels: map[string]string{"app": "app2"}},
+		{Name: "host-network1", IP: "10.10.1.9", Labels: map[string]string{"app": "app3"}},
+		{Name: "host-network2", IP: "10.10.1.9", Labels: map[string]string{"app": "app4"}},
+	}, []string{"app"}, map[string]string{}, Opts{DestinationWorkloadLabel: true})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="10.10.1.3:8080",destination_label_app="app2",destination_name="",destination_workload="my-container2",destination_zone="",direction="outgoing",ip_family="ipv4",label_app="app1",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination="10.10.1.3:8080"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="10.96.0.1:80",destination_label_app="app2",destination_name="",destination_workload="my-container2",destination_zone="",direction="outgoing",ip_family="ipv4",label_app="app1",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination="10.10.1.3:8080"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_label_app="",destination_name="alice-service",destination_workload="",destination_zone="",direction="outgoing",ip_family="ipv4",label_app="app1",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="10.10.1.9:9100",destination_label_app="",destination_name="",destination_workload="",destination_zone="",direction="outgoing",ip_family="ipv4",label_app="app1",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination="10.10.1.9:9100"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="10.96.0.1:80",destination_label_app="app2",destination_name="",destination_workload="my-container2",destination_zone="",ip_family="ipv4",label_app="app1",translated_destination="10.10.1.3:8080"} 20`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container2",destination=":8080",destination_label_app="",destination_name="",destination_workload="",destination_zone="",direction="incoming",ip_family="ipv4",label_app="app2",protocol="TCP",state="ESTABLISHED",status="unreplied",translated_destination=":8080"} 1`)
+}
+
+func TestCollectorSources(t *testing.T) {
+	conns := []*Conn{
+		{ID: 1, OriginIP: "192.168.50.4", OriginPort: 33404, DestIP: "10.10.1.2", DestPort: 7070, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 10},
+		{ID: 2, OriginIP: "192.168.50.5", OriginPort: 33405, DestIP: "10.10.1.2", DestPort: 7070, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 20},
+		{ID: 3, OriginIP: "172.16.0.1", OriginPort: 33406, DestIP: "10.10.1.2", DestPort: 7070, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 40},
+		{ID: 4, OriginIP: "10.10.1.2", OriginPort: 33407, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+	}
+	collector := newTestCollector(t, func() ([]*Conn, error) { return conns, nil }, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{"192.168.0.0/16": "internal"}, Opts{SourceLabel: true})
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination=":7070",destination_name="",destination_zone="",direction="incoming",ip_family="ipv4",protocol="TCP",source="192.168.50.4",source_name="alice-service",source_zone="internal",state="ESTABLISHED",status="unreplied",translated_destination=":7070"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination=":7070",destination_name="",destination_zone="",direction="incoming",ip_family="ipv4",protocol="TCP",source="172.16.0.1",source_name="",source_zone="",state="ESTABLISHED",status="unreplied",translated_destination=":7070"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="internal",direction="outgoing",ip_family="ipv4",protocol="TCP",source="",source_name="",source_zone="",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 1`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination=":7070",destination_name="",destination_zone="",ip_family="ipv4",source="192.168.50.5",source_name="bob-service",source_zone="internal",translated_destination=":7070"} 20`)
+
+	collector = newTestCollector(t, func() ([]*Conn, error) { return conns, nil }, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{"192.168.0.0/16": "internal"}, Opts{SourceClasses: true})
+
+	lines = scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination=":7070",destination_name="",destination_zone="",direction="incoming",ip_family="ipv4",protocol="TCP",source="",source_name="",source_zone="internal",state="ESTABLISHED",status="unreplied",translated_destination=":7070"} 2`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination=":7070",destination_name="",destination_zone="",ip_family="ipv4",source="",source_name="",source_zone="internal",translated_destination=":7070"} 30`)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination=":7070",destination_name="",destination_zone="",ip_family="ipv4",source="",source_name="",source_zone="",translated_destination=":7070"} 40`)
+}
+
+func TestCollectorForwarded(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "172.16.0.1", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 443, ReplyOriginIP: "192.168.50.4", ReplyOriginPort: 443, ReplyDestIP: "10.0.0.1", Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 10},
+				{ID: 2, OriginIP: "172.16.0.2", OriginPort: 33405, DestIP: "192.168.50.4", DestPort: 443, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 20},
+				{ID: 3, OriginIP: "10.10.1.2", OriginPort: 33406, DestIP: "192.168.50.5", DestPort: 443, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+				{ID: 4, OriginIP: "10.0.0.1", OriginPort: 33407, DestIP: "192.168.50.5", DestPort: 443, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+				{ID: 5, OriginIP: "127.0.0.1", OriginPort: 33408, DestIP: "127.0.0.1", DestPort: 9100, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP"},
+				{ID: 6, OriginIP: "172.17.0.2", OriginPort: 33409, DestIP: "172.17.0.1", DestPort: 53, Family: "ipv4", State: "OPEN", Protocol: "UDP"},
+			},
+		},
+	}
+
+	collector := newTestCollector(t, conntrack.conntrack, []*workload.Workload{
+		{Name: "my-container1", IP: "10.10.1.2"},
+	}, []string{}, map[string]string{"172.16.0.0/12": "office", "192.168.0.0/16": "internal"}, Opts{Forwarded: true, SourceClasses: true})
+	collector.nodeIPs = map[string]struct{}{"10.0.0.1": {}}
+	collector.localIPs = map[string]struct{}{"10.0.0.1": {}, "172.17.0.1": {}}
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_node_connections{destination="192.168.50.4:443",destination_name="alice-service",destination_zone="internal",direction="forwarded",ip_family="ipv4",protocol="TCP",source="",source_name="",source_zone="office",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:443"} 2`)
+	assert.Contains(t, lines, `conntrack_node_origin_bytes_total{destination="192.168.50.4:443",destination_name="alice-service",destination_zone="internal",ip_family="ipv4",source="",source_name="",source_zone="office",translated_destination="192.168.50.4:443"} 30`)
+	assert.Contains(t, lines, `conntrack_node_connections{destination="192.168.50.5:443",destination_name="bob-service",destination_zone="internal",direction="outgoing",ip_family="ipv4",protocol="TCP",source="",source_name="",source_zone="",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.5:443"} 1`)
+	forwarded := 0
+	for _, line := range lines {
+		if strings.Contains(line, `direction="forwarded"`) {
+			forwarded++
+		}
+	}
+	assert.Equal(t, 1, forwarded)
+}
+
+func BenchmarkCollectorUpdate(b *testing.B) {
+	for _, numWorkloads := range []int{10, 200, 500} {
+		for _, numConns := range []int{10000, 300000, 1000000} {
+			workloads := make([]*workload.Workload, numWorkloads)
+			for i := range workloads {
+				workloads[i] = &workload.Workload{Name: fmt.Sprintf("workload-%d", i), IP: fmt.Sprintf("10.%d.%d.2", i/256, i%256)}
+			}
+			conns := make([]*Conn, numConns)
+			for i := range conns {
+				w := i % (numWorkloads * 2)
+				conns[i] = &Conn{
+					ID:         uint32(i),
+					OriginIP:   fmt.Sprintf("10.%d.%d.2", w/256, w%256),
+					OriginPort: uint16(i % 65536),
+					DestIP:     fmt.Sprintf("192.168.%d.%d", i%100, i%200),
+					DestPort:   443,
+					Family:     "ipv4",
+					State:      "ESTABLISHED",
+					Protocol:   "TCP",
+				}
+			}
+
+			classifier, err := NewCIDRClassifier(map[string]string{})
+			require.NoError(b, err)
+			collector, err := New(
+				workloadTesting.New("containerd", "container", workloads),
+				func() ([]*Conn, error) { return conns, nil },
+				[]string{},
+				&fakeDNSCache{},
+				classifier,
+				Opts{},
+			)
+			require.NoError(b, err)
+
+			b.Run(fmt.Sprintf("workloads=%d/conns=%d", numWorkloads, numConns), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, _, err := collector.update()
+					require.NoError(b, err)
+				}
+			})
+		}
+	}
 }
 
 func TestPerformMetricClean(t *testing.T) {
@@ -111,6 +656,25 @@ func TestPerformMetricClean(t *testing.T) {
 	assert.Equal(t, []string{"w2", "w3"}, keys)
 }
 
+func TestSkipIp(t *testing.T) {
+	assert.True(t, skipIp("127.0.0.1"))
+	assert.True(t, skipIp("::1"))
+	assert.True(t, skipIp("169.254.1.1"))
+	assert.True(t, skipIp("fe80::1"))
+	assert.True(t, skipIp("invalid"))
+	assert.False(t, skipIp("10.10.1.2"))
+	assert.False(t, skipIp("2001:db8::1"))
+}
+
+func TestDestinationString(t *testing.T) {
+	assert.Equal(t, "10.10.1.2:80", (&destination{ip: "10.10.1.2", port: 80}).String())
+	assert.Equal(t, "[2001:db8::1]:80", (&destination{ip: "2001:db8::1", port: 80}).String())
+	assert.Equal(t, ":80", (&destination{port: 80}).String())
+	assert.Equal(t, "10.10.1.2 type=8 code=0", (&destination{ip: "10.10.1.2", icmp: "type=8 code=0"}).String())
+	assert.Equal(t, "type=8 code=0", (&destination{icmp: "type=8 code=0"}).String())
+	assert.Equal(t, "10.10.1.2", (&destination{ip: "10.10.1.2"}).String())
+}
+
 func BenchmarkCollector(b *testing.B) {
 	conns := []*Conn{
 		{OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, State: "ESTABLISHED", Protocol: "tcp"},
@@ -143,6 +707,7 @@ func BenchmarkCollector(b *testing.B) {
 		[]string{},
 		&fakeDNSCache{},
 		classifier,
+		Opts{},
 	)
 	ch := make(chan prometheus.Metric)
 	for n := 0; n < b.N; n++ {
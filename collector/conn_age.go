@@ -0,0 +1,221 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connectionAgeBuckets goes from a second to a day
+var connectionAgeBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 21600, 86400}
+
+// synSentAgeBuckets covers the SYN retransmissions, which last about two
+// minutes with the default net.ipv4.tcp_syn_retries
+var synSentAgeBuckets = []float64{10, 15, 30, 60, 90, 120, 180, 300}
+
+type durationHistogram struct {
+	bounds   []float64
+	buckets  []uint64
+	count    uint64
+	sum      float64
+	lastUsed time.Time
+}
+
+func newDurationHistogram(bounds []float64) *durationHistogram {
+	return &durationHistogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *durationHistogram) observe(d time.Duration, now time.Time) {
+	seconds := d.Seconds()
+	if seconds < 0 {
+		seconds = 0
+	}
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+	h.lastUsed = now
+}
+
+func (h *durationHistogram) metric(desc *prometheus.Desc, labels []string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.bounds))
+	for i, bound := range h.bounds {
+		buckets[bound] = h.buckets[i]
+	}
+	return prometheus.MustNewConstHistogram(desc, h.count, h.sum, buckets, labels...)
+}
+
+// closeGrace is how long a connection must be gone before it is considered
+// closed, connections go through states that are not exported (ie: FIN-WAIT)
+// before showing up again (ie: TIME-WAIT).
+var closeGrace = unusedConnectionTTL
+
+// closingStates are the TCP states after ESTABLISHED, a connection ends when
+// it is first seen on one of them, the time spent on them (ie: TIME-WAIT) is
+// not part of its lifetime.
+var closingStates = map[string]struct{}{
+	"FIN-WAIT":   {},
+	"CLOSE-WAIT": {},
+	"LAST-ACK":   {},
+	"TIME-WAIT":  {},
+	"CLOSE":      {},
+}
+
+// connEnd returns when conn ended: when it started closing if known (events),
+// when it was destroyed or now, when it is first seen closing.
+func connEnd(conn *Conn, now time.Time) time.Time {
+	if !conn.Closing.IsZero() {
+		return conn.Closing
+	}
+	if !conn.Stop.IsZero() {
+		return conn.Stop
+	}
+	return now
+}
+
+type openConnKey struct {
+	id  uint32
+	key connTrafficKey
+}
+
+type openConn struct {
+	start    time.Time
+	lastSeen time.Time
+	// ended is set once the lifetime is recorded
+	ended bool
+}
+
+// connAgeTracker depends on the start timestamp of the entries
+// (nf_conntrack_timestamp). With connectionAge, it observes the ages of the
+// open connections on every scrape and the lifetime of the connections seen
+// closing, either on a closing state, reported as closed or gone for
+// closeGrace. With synSent, the ages of the connections stuck on SYN-SENT are
+// observed on every scrape.
+type connAgeTracker struct {
+	sync.Mutex
+	connectionAge bool
+	synSent       bool
+	open          map[openConnKey]*openConn
+	ages          map[connTrafficKey]*durationHistogram
+	lifetimes     map[connTrafficKey]*durationHistogram
+	synSentAges   map[connTrafficKey]*durationHistogram
+	synSentOldest map[connTrafficKey]time.Duration
+}
+
+func newConnAgeTracker(connectionAge, synSent bool) *connAgeTracker {
+	return &connAgeTracker{
+		connectionAge: connectionAge,
+		synSent:       synSent,
+		open:          map[openConnKey]*openConn{},
+		ages:          map[connTrafficKey]*durationHistogram{},
+		lifetimes:     map[connTrafficKey]*durationHistogram{},
+		synSentAges:   map[connTrafficKey]*durationHistogram{},
+		synSentOldest: map[connTrafficKey]time.Duration{},
+	}
+}
+
+// begin drops the oldest SYN-SENT ages of the previous scrape, the
+// histograms are kept
+func (t *connAgeTracker) begin() {
+	t.synSentOldest = map[connTrafficKey]time.Duration{}
+}
+
+func (t *connAgeTracker) track(key connTrafficKey, conn *Conn, now time.Time) {
+	if conn.Start.IsZero() {
+		return
+	}
+
+	if t.connectionAge {
+		t.trackAge(key, conn, now)
+	}
+	if conn.Closed {
+		return
+	}
+
+	age := now.Sub(conn.Start)
+
+	// SYN-SENT connections are only exported after the toleration, so they
+	// are all stuck
+	if t.synSent && conn.State == "SYN-SENT" {
+		h, ok := t.synSentAges[key]
+		if !ok {
+			h = newDurationHistogram(synSentAgeBuckets)
+			t.synSentAges[key] = h
+		}
+		h.observe(age, now)
+		if age > t.synSentOldest[key] {
+			t.synSentOldest[key] = age
+		}
+	}
+}
+
+func (t *connAgeTracker) trackAge(key connTrafficKey, conn *Conn, now time.Time) {
+	openKey := openConnKey{id: conn.ID, key: key}
+	open, ok := t.open[openKey]
+	if conn.Closed {
+		if !ok || !open.ended {
+			t.observeLifetime(key, connEnd(conn, now).Sub(conn.Start), now)
+		}
+		delete(t.open, openKey)
+		return
+	}
+
+	if !ok {
+		open = &openConn{start: conn.Start}
+		t.open[openKey] = open
+	}
+	open.lastSeen = now
+	if _, closing := closingStates[conn.State]; closing {
+		// kept until gone, so it is not recorded again
+		if !open.ended {
+			t.observeLifetime(key, connEnd(conn, now).Sub(conn.Start), now)
+			open.ended = true
+		}
+		return
+	}
+
+	h, ok := t.ages[key]
+	if !ok {
+		h = newDurationHistogram(connectionAgeBuckets)
+		t.ages[key] = h
+	}
+	h.observe(now.Sub(conn.Start), now)
+}
+
+// end records the lifetime of the connections gone for closeGrace without
+// being seen closing, up to when they were last seen.
+func (t *connAgeTracker) end(now time.Time) {
+	for openKey, conn := range t.open {
+		if now.Sub(conn.lastSeen) > closeGrace {
+			if !conn.ended {
+				t.observeLifetime(openKey.key, conn.lastSeen.Sub(conn.start), now)
+			}
+			delete(t.open, openKey)
+		}
+	}
+
+	for _, histograms := range []map[connTrafficKey]*durationHistogram{t.ages, t.lifetimes, t.synSentAges} {
+		for key, h := range histograms {
+			if now.After(h.lastUsed.Add(unusedConnectionTTL)) {
+				delete(histograms, key)
+			}
+		}
+	}
+}
+
+func (t *connAgeTracker) observeLifetime(key connTrafficKey, lifetime time.Duration, now time.Time) {
+	h, ok := t.lifetimes[key]
+	if !ok {
+		h = newDurationHistogram(connectionAgeBuckets)
+		t.lifetimes[key] = h
+	}
+	h.observe(lifetime, now)
+}
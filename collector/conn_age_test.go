@@ -0,0 +1,147 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnAgeTracker(t *testing.T) {
+	now := time.Now().UTC()
+	key := connTrafficKey{Workload: "w1", IP: "10.1.1.1", Port: 8000}
+	tracker := newConnAgeTracker(true, true)
+
+	tracker.begin()
+	tracker.track(key, &Conn{ID: 1, Start: now.Add(-10 * time.Second)}, now)
+	tracker.track(key, &Conn{ID: 2, Start: now.Add(-2 * time.Hour)}, now)
+	tracker.track(key, &Conn{ID: 3}, now)
+	tracker.track(key, &Conn{ID: 5, State: "SYN-SENT", Start: now.Add(-20 * time.Second)}, now)
+	tracker.track(key, &Conn{ID: 6, State: "SYN-SENT", Start: now.Add(-70 * time.Second)}, now)
+	tracker.track(key, &Conn{ID: 4, Start: now.Add(-time.Minute), Stop: now.Add(-50 * time.Second), Closed: true}, now)
+	tracker.end(now)
+
+	require.Contains(t, tracker.ages, key)
+	assert.Equal(t, uint64(4), tracker.ages[key].count)
+	assert.Equal(t, float64(7300), tracker.ages[key].sum)
+	require.Contains(t, tracker.synSentAges, key)
+	assert.Equal(t, []uint64{0, 0, 1, 1, 2, 2, 2, 2}, tracker.synSentAges[key].buckets)
+	assert.Equal(t, 70*time.Second, tracker.synSentOldest[key])
+	require.Contains(t, tracker.lifetimes, key)
+	assert.Equal(t, uint64(1), tracker.lifetimes[key].count)
+	assert.Equal(t, float64(10), tracker.lifetimes[key].sum)
+
+	// connection 1 is gone and connection 2 is reported as closed
+	later := now.Add(20 * time.Second)
+	tracker.begin()
+	tracker.track(key, &Conn{ID: 2, Start: now.Add(-2 * time.Hour), Stop: later, Closed: true}, later)
+	tracker.end(later)
+
+	assert.Equal(t, uint64(4), tracker.ages[key].count)
+	assert.Equal(t, uint64(2), tracker.synSentAges[key].count)
+	assert.NotContains(t, tracker.synSentOldest, key)
+	assert.Equal(t, uint64(2), tracker.lifetimes[key].count)
+	assert.Equal(t, float64(10+7220), tracker.lifetimes[key].sum)
+
+	// connections gone for longer than closeGrace are closed when last seen
+	later = later.Add(closeGrace + time.Second)
+	tracker.begin()
+	tracker.end(later)
+	assert.Equal(t, uint64(5), tracker.lifetimes[key].count)
+	assert.Equal(t, float64(10+7220+10+20+70), tracker.lifetimes[key].sum)
+	assert.Empty(t, tracker.open)
+
+	tracker.begin()
+	tracker.end(later.Add(unusedConnectionTTL + time.Second))
+	assert.Empty(t, tracker.ages)
+	assert.Empty(t, tracker.lifetimes)
+	assert.Empty(t, tracker.synSentAges)
+}
+
+func TestConnAgeTrackerHiddenStates(t *testing.T) {
+	now := time.Now().UTC()
+	key1 := connTrafficKey{Workload: "w1", IP: "10.1.1.1", Port: 8000}
+	key2 := connTrafficKey{Workload: "w2", IP: "10.1.1.1", Port: 8000}
+	conn := &Conn{ID: 1, Start: now.Add(-time.Minute)}
+	tracker := newConnAgeTracker(true, false)
+
+	// the same connection matches two workloads
+	tracker.begin()
+	tracker.track(key1, conn, now)
+	tracker.track(key2, conn, now)
+	// SYN-SENT ages are off
+	tracker.track(connTrafficKey{Workload: "w3", IP: "10.1.1.1", Port: 8000}, &Conn{ID: 2, State: "SYN-SENT", Start: now.Add(-time.Minute)}, now)
+	tracker.end(now)
+	assert.Len(t, tracker.open, 3)
+	assert.Empty(t, tracker.synSentAges)
+	assert.Empty(t, tracker.synSentOldest)
+
+	// not exported while on FIN-WAIT, it shows up again on TIME-WAIT and ends
+	// when first seen closing
+	later := now.Add(time.Second)
+	tracker.begin()
+	tracker.end(later)
+	later = later.Add(time.Second)
+	timeWait := &Conn{ID: 1, State: "TIME-WAIT", Start: now.Add(-time.Minute)}
+	tracker.begin()
+	tracker.track(key1, timeWait, later)
+	tracker.track(key2, timeWait, later)
+	tracker.end(later)
+	require.Contains(t, tracker.lifetimes, key1)
+	require.Contains(t, tracker.lifetimes, key2)
+	assert.Equal(t, uint64(1), tracker.lifetimes[key1].count)
+	assert.Equal(t, float64(62), tracker.lifetimes[key1].sum)
+	assert.Equal(t, uint64(1), tracker.lifetimes[key2].count)
+	assert.Equal(t, uint64(1), tracker.ages[key1].count)
+
+	// neither while still on TIME-WAIT nor when gone
+	later = later.Add(time.Second)
+	tracker.begin()
+	tracker.track(key1, timeWait, later)
+	tracker.end(later)
+	assert.Equal(t, uint64(1), tracker.lifetimes[key1].count)
+	later = later.Add(closeGrace + time.Second)
+	tracker.begin()
+	tracker.end(later)
+	// unused since recorded, so they expired
+	assert.NotContains(t, tracker.lifetimes, key1)
+	assert.NotContains(t, tracker.lifetimes, key2)
+	assert.Empty(t, tracker.open)
+}
+
+func TestConnAgeTrackerClosing(t *testing.T) {
+	now := time.Now().UTC()
+	key := connTrafficKey{Workload: "w1", IP: "10.1.1.1", Port: 8000}
+	tracker := newConnAgeTracker(true, false)
+
+	// the events source knows when the connection started closing
+	tracker.begin()
+	tracker.track(key, &Conn{ID: 1, State: "FIN-WAIT", Start: now.Add(-time.Minute), Closing: now.Add(-30 * time.Second)}, now)
+	tracker.track(key, &Conn{ID: 2, Start: now.Add(-time.Minute), Closing: now.Add(-20 * time.Second), Stop: now, Closed: true}, now)
+	tracker.end(now)
+	assert.Equal(t, uint64(2), tracker.lifetimes[key].count)
+	assert.Equal(t, float64(30+40), tracker.lifetimes[key].sum)
+
+	// the closing connection is destroyed afterwards
+	tracker.begin()
+	tracker.track(key, &Conn{ID: 1, Start: now.Add(-time.Minute), Closing: now.Add(-30 * time.Second), Stop: now, Closed: true}, now)
+	tracker.end(now)
+	assert.Equal(t, uint64(2), tracker.lifetimes[key].count)
+	assert.Empty(t, tracker.open)
+}
+
+func TestDurationHistogram(t *testing.T) {
+	h := newDurationHistogram(connectionAgeBuckets)
+	h.observe(500*time.Millisecond, time.Now())
+	h.observe(10*time.Second, time.Now())
+	h.observe(-time.Second, time.Now())
+	h.observe(48*time.Hour, time.Now())
+
+	assert.Equal(t, uint64(4), h.count)
+	assert.Equal(t, []uint64{2, 2, 3, 3, 3, 3, 3, 3, 3, 3, 3}, h.buckets)
+}
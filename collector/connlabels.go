@@ -0,0 +1,115 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+)
+
+// connLabels holds the connlabels of entries by entry ID, go-conntrack
+// discards them so they are parsed apart from the entries.
+type connLabels map[uint32]string
+
+// apply sets the connlabels of conns found in l.
+func (l connLabels) apply(conns []*Conn) {
+	if len(l) == 0 {
+		return
+	}
+	for _, conn := range conns {
+		conn.Labels = l[conn.ID]
+	}
+}
+
+// formatConnLabels returns the numbers of the bits set on a connlabels
+// bitmap, comma separated and in ascending order (ie: "1,5").
+func formatConnLabels(bitmap []byte) string {
+	bits := []string{}
+	for i := 0; i < len(bitmap)*8; i++ {
+		if bitmap[i/8]&(1<<uint(i%8)) != 0 {
+			bits = append(bits, strconv.Itoa(i))
+		}
+	}
+	return strings.Join(bits, ",")
+}
+
+// parseProcConnLabels parses the labels= field of the procfs conntrack table,
+// the bitmap printed in hex.
+func parseProcConnLabels(value string) (string, error) {
+	bitmap, err := hex.DecodeString(value)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid labels")
+	}
+	return formatConnLabels(bitmap), nil
+}
+
+// netlinkConnLabels returns the connlabels of a conntrack netlink message,
+// from its CTA_LABELS attribute.
+func netlinkConnLabels(data []byte) (string, error) {
+	if len(data) < nfgenmsgSize {
+		return "", nil
+	}
+	ad, err := netlink.NewAttributeDecoder(data[nfgenmsgSize:])
+	if err != nil {
+		return "", errors.Wrap(err, "Could not decode conntrack attributes")
+	}
+	labels := ""
+	for ad.Next() {
+		if ad.Type() == CTA_LABELS {
+			labels = formatConnLabels(ad.Bytes())
+		}
+	}
+	if err = ad.Err(); err != nil {
+		return "", errors.Wrap(err, "Could not decode conntrack attributes")
+	}
+	return labels, nil
+}
+
+// LoadConnlabelNames reads the names of the connlabel bits in the format of
+// connlabel.conf, one bit per line, ie:
+//
+//	# labels set by -m connlabel --set
+//	1 egress-proxy
+//	2 vpn
+func LoadConnlabelNames(path string) (map[int]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open connlabel file")
+	}
+	defer f.Close()
+
+	names := map[int]string{}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid connlabel at line %d: %q", lineNumber, line)
+		}
+
+		bit, err := strconv.ParseUint(fields[0], 0, 7)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid connlabel bit at line %d", lineNumber)
+		}
+		names[int(bit)] = fields[1]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Could not read connlabel file")
+	}
+
+	return names, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatConnLabels(t *testing.T) {
+	assert.Equal(t, "", formatConnLabels(make([]byte, 16)))
+	assert.Equal(t, "0,1,5,8,127", formatConnLabels([]byte{0x23, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80}))
+}
+
+func TestNetlinkConnLabels(t *testing.T) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint8(CTA_TUPLE_ORIG, 1)
+	ae.Bytes(CTA_LABELS, []byte{0x22, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	attrs, err := ae.Encode()
+	require.NoError(t, err)
+
+	labels, err := netlinkConnLabels(append([]byte{2, 0, 0, 0}, attrs...))
+	require.NoError(t, err)
+	assert.Equal(t, "1,5", labels)
+
+	labels, err = netlinkConnLabels([]byte{2, 0, 0, 0})
+	require.NoError(t, err)
+	assert.Equal(t, "", labels)
+
+	_, err = netlinkConnLabels([]byte{2, 0, 0, 0, 8, 0})
+	assert.Error(t, err)
+}
+
+func TestConnLabelsApply(t *testing.T) {
+	conns := []*Conn{{ID: 1}, {ID: 2}}
+	connLabels{1: "1,5"}.apply(conns)
+	assert.Equal(t, "1,5", conns[0].Labels)
+	assert.Equal(t, "", conns[1].Labels)
+}
+
+func TestLoadConnlabelNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "connlabel.conf")
+	err := os.WriteFile(path, []byte("# labels set by -m connlabel --set\n\n1 egress-proxy\n 5\tvpn \n"), 0644)
+	require.NoError(t, err)
+
+	names, err := LoadConnlabelNames(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]string{1: "egress-proxy", 5: "vpn"}, names)
+}
+
+func TestLoadConnlabelNamesInvalid(t *testing.T) {
+	for _, content := range []string{"1", "1 vpn extra", "abc vpn", "128 vpn"} {
+		path := filepath.Join(t.TempDir(), "connlabel.conf")
+		err := os.WriteFile(path, []byte(content), 0644)
+		require.NoError(t, err)
+
+		_, err = LoadConnlabelNames(path)
+		assert.Error(t, err, content)
+	}
+
+	_, err := LoadConnlabelNames(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -5,6 +5,9 @@
 package collector
 
 import (
+	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	ct "github.com/florianl/go-conntrack"
@@ -13,18 +16,141 @@ import (
 
 var (
 	// copied from: https://github.com/torvalds/linux/blob/master/include/uapi/linux/netfilter/nf_conntrack_tcp.h#L9
+	TCP_CONNTRACK_NONE        uint8 = 0
 	TCP_CONNTRACK_SYN_SENT    uint8 = 1
+	TCP_CONNTRACK_SYN_RECV    uint8 = 2
 	TCP_CONNTRACK_ESTABLISHED uint8 = 3
+	TCP_CONNTRACK_FIN_WAIT    uint8 = 4
 	TCP_CONNTRACK_CLOSE_WAIT  uint8 = 5
 	TCP_CONNTRACK_LAST_ACK    uint8 = 6
 	TCP_CONNTRACK_TIME_WAIT   uint8 = 7
+	TCP_CONNTRACK_CLOSE       uint8 = 8
+	TCP_CONNTRACK_SYN_SENT2   uint8 = 9
+
+	// copied from: https://github.com/torvalds/linux/blob/master/include/uapi/linux/netfilter/nf_conntrack_sctp.h
+	SCTP_CONNTRACK_NONE              uint8 = 0
+	SCTP_CONNTRACK_CLOSED            uint8 = 1
+	SCTP_CONNTRACK_COOKIE_WAIT       uint8 = 2
+	SCTP_CONNTRACK_COOKIE_ECHOED     uint8 = 3
+	SCTP_CONNTRACK_ESTABLISHED       uint8 = 4
+	SCTP_CONNTRACK_SHUTDOWN_SENT     uint8 = 5
+	SCTP_CONNTRACK_SHUTDOWN_RECD     uint8 = 6
+	SCTP_CONNTRACK_SHUTDOWN_ACK_SENT uint8 = 7
+	SCTP_CONNTRACK_HEARTBEAT_SENT    uint8 = 8
+	SCTP_CONNTRACK_HEARTBEAT_ACKED   uint8 = 9
+
+	// copied from: https://github.com/torvalds/linux/blob/master/include/uapi/linux/netfilter/nf_conntrack_common.h
+	IPS_SEEN_REPLY uint32 = 1 << 1
+	IPS_ASSURED    uint32 = 1 << 2
+	IPS_DYING      uint32 = 1 << 9
 
 	// copied from: https://github.com/torvalds/linux/blob/0d81a3f29c0afb18ba2b1275dcccf21e0dd4da38/include/uapi/linux/in.h#L28
-	IPPROTO_TCP uint8 = 6
-	IPPROTO_UDP uint8 = 17
+	IPPROTO_ICMP   uint8 = 1
+	IPPROTO_TCP    uint8 = 6
+	IPPROTO_UDP    uint8 = 17
+	IPPROTO_GRE    uint8 = 47
+	IPPROTO_ICMPV6 uint8 = 58
+	IPPROTO_SCTP   uint8 = 132
+)
+
+var protocolNames = map[uint8]string{
+	IPPROTO_TCP:    "TCP",
+	IPPROTO_UDP:    "UDP",
+	IPPROTO_SCTP:   "SCTP",
+	IPPROTO_ICMP:   "ICMP",
+	IPPROTO_ICMPV6: "ICMPv6",
+	IPPROTO_GRE:    "GRE",
+}
+
+var sctpStateNames = map[uint8]string{
+	SCTP_CONNTRACK_NONE:              "NONE",
+	SCTP_CONNTRACK_CLOSED:            "CLOSED",
+	SCTP_CONNTRACK_COOKIE_WAIT:       "COOKIE-WAIT",
+	SCTP_CONNTRACK_COOKIE_ECHOED:     "COOKIE-ECHOED",
+	SCTP_CONNTRACK_ESTABLISHED:       "ESTABLISHED",
+	SCTP_CONNTRACK_SHUTDOWN_SENT:     "SHUTDOWN-SENT",
+	SCTP_CONNTRACK_SHUTDOWN_RECD:     "SHUTDOWN-RECD",
+	SCTP_CONNTRACK_SHUTDOWN_ACK_SENT: "SHUTDOWN-ACK-SENT",
+	SCTP_CONNTRACK_HEARTBEAT_SENT:    "HEARTBEAT-SENT",
+	SCTP_CONNTRACK_HEARTBEAT_ACKED:   "HEARTBEAT-ACKED",
+}
+
+// DefaultSynSentToleration is how long a connection stays on SYN-SENT
+// before being exported as stuck
+const DefaultSynSentToleration = time.Second * 10
+
+var syncSentToleration = DefaultSynSentToleration
+
+// SetSynSentToleration changes how long a connection stays on SYN-SENT
+// before being exported as stuck.
+func SetSynSentToleration(toleration time.Duration) error {
+	if toleration < 0 {
+		return errors.Errorf("invalid SYN-SENT toleration: %s", toleration)
+	}
+
+	syncSentToleration = toleration
+	return nil
+}
+
+var tcpStateNames = map[uint8]string{
+	TCP_CONNTRACK_NONE:        "NONE",
+	TCP_CONNTRACK_SYN_SENT:    "SYN-SENT",
+	TCP_CONNTRACK_SYN_RECV:    "SYN-RECV",
+	TCP_CONNTRACK_ESTABLISHED: "ESTABLISHED",
+	TCP_CONNTRACK_FIN_WAIT:    "FIN-WAIT",
+	TCP_CONNTRACK_CLOSE_WAIT:  "CLOSE-WAIT",
+	TCP_CONNTRACK_LAST_ACK:    "LAST-ACK",
+	TCP_CONNTRACK_TIME_WAIT:   "TIME-WAIT",
+	TCP_CONNTRACK_CLOSE:       "CLOSE",
+	TCP_CONNTRACK_SYN_SENT2:   "SYN-SENT2",
+}
+
+// DefaultTCPStates are the TCP states exported when -tcp-states is not set,
+// SYN-SENT connections are only exported after syncSentToleration.
+var DefaultTCPStates = []string{"ESTABLISHED", "CLOSE-WAIT", "TIME-WAIT", "SYN-SENT"}
+
+var allowedTCPStates = tcpStateSet(DefaultTCPStates)
+
+// SetTCPStates changes which TCP states are exported, states are separated by
+// comma (ie: ESTABLISHED,SYN-RECV), an empty string restores the default states.
+func SetTCPStates(states string) error {
+	if states == "" {
+		allowedTCPStates = tcpStateSet(DefaultTCPStates)
+		return nil
+	}
+
+	knownStates := map[string]bool{}
+	for _, name := range tcpStateNames {
+		knownStates[name] = true
+	}
+
+	names := []string{}
+	for _, state := range strings.Split(states, ",") {
+		state = strings.ReplaceAll(strings.ToUpper(strings.TrimSpace(state)), "_", "-")
+		if !knownStates[state] {
+			return errors.Errorf("unknown TCP state: %q", state)
+		}
+		names = append(names, state)
+	}
+
+	allowedTCPStates = tcpStateSet(names)
+	return nil
+}
+
+func tcpStateSet(states []string) map[string]bool {
+	set := map[string]bool{}
+	for _, state := range states {
+		set[state] = true
+	}
+	return set
+}
+
+var (
+	IPv4Family = "ipv4"
+	IPv6Family = "ipv6"
 )
 
-var syncSentToleration = time.Second * 10
+var families = []ct.Family{ct.IPv4, ct.IPv6}
 
 type Conn struct {
 	ID          uint32
@@ -32,24 +158,80 @@ type Conn struct {
 	DestIP      string
 	OriginPort  uint16
 	DestPort    uint16
+	Family      string
 	State       string
 	Protocol    string
 	OriginBytes uint64
 	ReplyBytes  uint64
+	// packet counters, as the byte counters they require nf_conntrack_acct
+	OriginPackets uint64
+	ReplyPackets  uint64
+	// reply tuple, it differs from the origin tuple when the connection is NAT'ed
+	ReplyOriginIP   string
+	ReplyDestIP     string
+	ReplyOriginPort uint16
+	ReplyDestPort   uint16
+	// ICMP and ICMPv6 are tracked by type and code instead of ports
+	IcmpType uint8
+	IcmpCode uint8
+	// conntrack zone and mark (ie: set by iptables CONNMARK)
+	Zone uint16
+	Mark uint32
+	// Labels are the connlabel bits set on the entry (ie: "1,5"), they are
+	// not known with conntrack events
+	Labels string
+	// Start and Stop are only known with nf_conntrack_timestamp enabled,
+	// Stop is only set on closed connections
+	Start time.Time
+	Stop  time.Time
+	// Closing is when the connection was first seen on a closing TCP state
+	// (ie: FIN-WAIT), only known with conntrack events
+	Closing time.Time
+	// Status is the bitmask of IPS_* flags of the entry
+	Status uint32
+	// AttemptResult is the outcome of a closed TCP or UDP connection, see
+	// attemptResult
+	AttemptResult string
+	// Closed is set on connections already destroyed by the kernel, they
+	// only contribute to the traffic counters with their final values
+	Closed bool
 }
 
-func conntrack(protocol string) ([]*Conn, error) {
+func conntrack(protocols []uint8) ([]*Conn, error) {
 	nfct, err := ct.Open(&ct.Config{})
 	if err != nil {
 		return nil, errors.Wrap(err, "Could not create nfct")
 	}
 	defer nfct.Close()
-	entries, err := nfct.Dump(ct.Conntrack, ct.IPv4)
+
+	entries, labels, err := dumpEntries(nfct, protocols)
 	if err != nil {
-		return nil, errors.Wrap(err, "Could not dump conntrack entries")
+		return nil, err
+	}
+
+	conns := convertContrackEntryToConn(entries)
+	labels.apply(conns)
+	return conns, nil
+}
+
+func dumpEntries(nfct *ct.Nfct, protocols []uint8) ([]ct.Con, connLabels, error) {
+	entries := []ct.Con{}
+	labels := connLabels{}
+	for _, family := range families {
+		var familyEntries []ct.Con
+		var err error
+		if len(protocols) == 0 {
+			familyEntries, err = dumpTable(nfct, family, labels)
+		} else {
+			familyEntries, err = dumpProtocols(nfct, family, protocols, labels)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Could not dump conntrack entries")
+		}
+		entries = append(entries, familyEntries...)
 	}
 
-	return convertContrackEntryToConn(entries), nil
+	return entries, labels, nil
 }
 
 func convertContrackEntryToConn(entries []ct.Con) []*Conn {
@@ -57,70 +239,260 @@ func convertContrackEntryToConn(entries []ct.Con) []*Conn {
 	conns := []*Conn{}
 	synSentDeadline := now.Add(syncSentToleration * -1)
 	for _, entry := range entries {
-
-		var id uint32
-		if entry.ID != nil {
-			id = *entry.ID
+		proto, state := extractPROTOAndState(&entry, synSentDeadline)
+		if state == "" {
+			continue
 		}
+		conns = append(conns, newConn(&entry, proto, state))
+	}
+	return conns
+}
+
+// convertClosedEntryToConn converts a destroyed entry regardless of its last
+// state, it is used only to account the traffic of the connection.
+func convertClosedEntryToConn(entry *ct.Con) *Conn {
+	if entry.Origin == nil || entry.Origin.Proto == nil || entry.Origin.Proto.Number == nil {
+		return nil
+	}
 
-		var originBytes uint64
-		if entry.CounterOrigin != nil {
-			originBytes = *entry.CounterOrigin.Bytes
+	proto := protocolNames[*entry.Origin.Proto.Number]
+	if proto == "" {
+		return nil
+	}
+
+	conn := newConn(entry, proto, "CLOSED")
+	conn.Closed = true
+	conn.AttemptResult = attemptResult(entry)
+	return conn
+}
+
+const (
+	AttemptEstablished = "established"
+	AttemptTimeout     = "timeout"
+	AttemptReset       = "reset"
+	AttemptReplied     = "replied"
+	AttemptUnreplied   = "unreplied"
+)
+
+// attemptResult classifies how a destroyed entry ended: TCP connections that
+// were assured reached ESTABLISHED, the ones destroyed on SYN-SENT timed out
+// and the others were reset. UDP flows are classified by having seen a reply.
+func attemptResult(entry *ct.Con) string {
+	var status uint32
+	if entry.Status != nil {
+		status = *entry.Status
+	}
+
+	switch *entry.Origin.Proto.Number {
+	case IPPROTO_TCP:
+		if status&IPS_ASSURED != 0 {
+			return AttemptEstablished
 		}
+		if entry.ProtoInfo != nil && entry.ProtoInfo.TCP != nil && entry.ProtoInfo.TCP.State != nil {
+			switch *entry.ProtoInfo.TCP.State {
+			case TCP_CONNTRACK_SYN_SENT, TCP_CONNTRACK_SYN_SENT2:
+				return AttemptTimeout
+			}
+		}
+		return AttemptReset
+	case IPPROTO_UDP:
+		if status&IPS_SEEN_REPLY != 0 {
+			return AttemptReplied
+		}
+		return AttemptUnreplied
+	}
+
+	return ""
+}
+
+func newConn(entry *ct.Con, proto, state string) *Conn {
+	var id uint32
+	if entry.ID != nil {
+		id = *entry.ID
+	}
 
-		var replyBytes uint64
-		if entry.CounterReply != nil {
-			replyBytes = *entry.CounterReply.Bytes
+	conn := &Conn{
+		ID:          id,
+		OriginIP:    entry.Origin.Src.String(),
+		OriginPort:  port(entry.Origin.Proto.SrcPort),
+		DestIP:      entry.Origin.Dst.String(),
+		DestPort:    port(entry.Origin.Proto.DstPort),
+		Family:      ipFamily(entry.Origin.Src),
+		State:       state,
+		OriginBytes: counterBytes(entry.CounterOrigin),
+		ReplyBytes:  counterBytes(entry.CounterReply),
+		Protocol:    proto,
+	}
+
+	if entry.Timestamp != nil {
+		if entry.Timestamp.Start != nil {
+			conn.Start = *entry.Timestamp.Start
 		}
+		if entry.Timestamp.Stop != nil {
+			conn.Stop = *entry.Timestamp.Stop
+		}
+	}
 
-		proto, state := extractPROTOAndState(&entry, synSentDeadline)
-		if state == "" {
-			continue
+	conn.OriginPackets = counterPackets(entry.CounterOrigin)
+	conn.ReplyPackets = counterPackets(entry.CounterReply)
+
+	if entry.Status != nil {
+		conn.Status = *entry.Status
+	}
+	if entry.Zone != nil {
+		conn.Zone = *entry.Zone
+	}
+	if entry.Mark != nil {
+		conn.Mark = *entry.Mark
+	}
+
+	if proto := entry.Origin.Proto; proto.IcmpType != nil {
+		conn.IcmpType, conn.IcmpCode = *proto.IcmpType, uint8Value(proto.IcmpCode)
+	} else if proto.Icmpv6Type != nil {
+		conn.IcmpType, conn.IcmpCode = *proto.Icmpv6Type, uint8Value(proto.Icmpv6Code)
+	}
+
+	if entry.Reply != nil {
+		conn.ReplyOriginIP = ipString(entry.Reply.Src)
+		conn.ReplyDestIP = ipString(entry.Reply.Dst)
+		if entry.Reply.Proto != nil {
+			conn.ReplyOriginPort = port(entry.Reply.Proto.SrcPort)
+			conn.ReplyDestPort = port(entry.Reply.Proto.DstPort)
 		}
-		conns = append(conns, &Conn{
-			ID:          id,
-			OriginIP:    entry.Origin.Src.String(),
-			OriginPort:  port(entry.Origin.Proto.SrcPort),
-			DestIP:      entry.Origin.Dst.String(),
-			DestPort:    port(entry.Origin.Proto.DstPort),
-			State:       state,
-			OriginBytes: originBytes,
-			ReplyBytes:  replyBytes,
-			Protocol:    proto,
-		})
 	}
-	return conns
+
+	return conn
+}
+
+// StatusName decodes the status bitmask: dying entries are being destroyed,
+// assured ones saw traffic in both directions long enough to be kept when the
+// table is full and unreplied ones never saw a reply.
+func (c *Conn) StatusName() string {
+	switch {
+	case c.Status&IPS_DYING != 0:
+		return "dying"
+	case c.Status&IPS_ASSURED != 0:
+		return "assured"
+	case c.Status&IPS_SEEN_REPLY != 0:
+		return "seen_reply"
+	}
+
+	return "unreplied"
+}
+
+// ICMP renders the ICMP type and code of ICMP connections, it is empty for
+// other protocols.
+func (c *Conn) ICMP() string {
+	if c.Protocol != "ICMP" && c.Protocol != "ICMPv6" {
+		return ""
+	}
+
+	return fmt.Sprintf("type=%d code=%d", c.IcmpType, c.IcmpCode)
+}
+
+// TranslatedDestination returns the real destination of the connection, after
+// DNAT, which is the origin of the reply tuple.
+func (c *Conn) TranslatedDestination() (string, uint16) {
+	if c.ReplyOriginIP == "" {
+		return c.DestIP, c.DestPort
+	}
+
+	return c.ReplyOriginIP, c.ReplyOriginPort
 }
 
 func extractPROTOAndState(entry *ct.Con, synSentDeadline time.Time) (proto, state string) {
-	if *entry.Origin.Proto.Number == IPPROTO_TCP && entry.ProtoInfo != nil && entry.ProtoInfo.TCP != nil {
-		if *entry.ProtoInfo.TCP.State == TCP_CONNTRACK_ESTABLISHED {
-			return "TCP", "ESTABLISHED"
+	if *entry.Origin.Proto.Number == IPPROTO_TCP && entry.ProtoInfo != nil && entry.ProtoInfo.TCP != nil && entry.ProtoInfo.TCP.State != nil {
+		state, ok := tcpStateNames[*entry.ProtoInfo.TCP.State]
+		if !ok || !allowedTCPStates[state] {
+			return "", ""
 		}
-		if *entry.ProtoInfo.TCP.State == TCP_CONNTRACK_CLOSE_WAIT {
-			return "TCP", "CLOSE-WAIT"
+		if *entry.ProtoInfo.TCP.State == TCP_CONNTRACK_SYN_SENT && (entry.Timestamp == nil || entry.Timestamp.Start == nil || !entry.Timestamp.Start.Before(synSentDeadline)) {
+			return "", ""
 		}
-		if *entry.ProtoInfo.TCP.State == TCP_CONNTRACK_TIME_WAIT {
-			return "TCP", "TIME-WAIT"
-		}
-		if *entry.ProtoInfo.TCP.State == TCP_CONNTRACK_SYN_SENT && entry.Timestamp != nil && entry.Timestamp.Start.Before(synSentDeadline) {
-			return "TCP", "SYN-SENT"
+
+		return "TCP", state
+	}
+
+	if *entry.Origin.Proto.Number == IPPROTO_SCTP && entry.ProtoInfo != nil && entry.ProtoInfo.SCTP != nil && entry.ProtoInfo.SCTP.State != nil {
+		state, ok := sctpStateNames[*entry.ProtoInfo.SCTP.State]
+		if !ok {
+			return "", ""
 		}
 
-		return "", ""
+		return "SCTP", state
 	}
 
-	if *entry.Origin.Proto.Number == IPPROTO_UDP {
-		return "UDP", "OPEN"
+	switch *entry.Origin.Proto.Number {
+	case IPPROTO_UDP, IPPROTO_ICMP, IPPROTO_ICMPV6, IPPROTO_GRE:
+		return protocolNames[*entry.Origin.Proto.Number], "OPEN"
 	}
 
 	return "", ""
 }
 
-func NewConntrack(protocol string) Conntrack {
+// NewConntrack returns a Conntrack that dumps only the given protocols
+// (ie: tcp,udp), filtering is done by the kernel when it is supported.
+func NewConntrack(protocol string) (Conntrack, error) {
+	protocols, err := ParseProtocols(protocol)
+	if err != nil {
+		return nil, err
+	}
+
 	return func() ([]*Conn, error) {
-		return conntrack(protocol)
+		return conntrack(protocols)
+	}, nil
+}
+
+func ipString(ip *net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+func ipFamily(ip *net.IP) string {
+	if ip == nil || ip.To4() != nil {
+		return IPv4Family
+	}
+
+	return IPv6Family
+}
+
+func counterPackets(c *ct.Counter) uint64 {
+	if c == nil {
+		return 0
 	}
+	if c.Packets != nil {
+		return *c.Packets
+	}
+	if c.Packets32 != nil {
+		return uint64(*c.Packets32)
+	}
+
+	return 0
+}
+
+func counterBytes(c *ct.Counter) uint64 {
+	if c == nil {
+		return 0
+	}
+	if c.Bytes != nil {
+		return *c.Bytes
+	}
+	if c.Bytes32 != nil {
+		return uint64(*c.Bytes32)
+	}
+
+	return 0
+}
+
+func uint8Value(v *uint8) uint8 {
+	if v == nil {
+		return 0
+	}
+
+	return *v
 }
 
 func port(p *uint16) uint16 {
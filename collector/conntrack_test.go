@@ -11,11 +11,14 @@ import (
 
 	ct "github.com/florianl/go-conntrack"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConvertContrackEntryToConn(t *testing.T) {
 	now := time.Now().UTC()
 	delayedConnStart := now.Add(time.Minute * -1)
+	zone := uint16(3)
+	mark := uint32(0x10)
 
 	ctConn := []ct.Con{
 		{
@@ -95,6 +98,8 @@ func TestConvertContrackEntryToConn(t *testing.T) {
 				Src: parseIP("192.0.2.51"), Proto: &ct.ProtoTuple{Number: &IPPROTO_UDP, SrcPort: portPtr(8081)},
 				Dst: parseIP("192.0.2.50"),
 			},
+			Zone: &zone,
+			Mark: &mark,
 		},
 		{
 			Origin: &ct.IPTuple{
@@ -107,15 +112,27 @@ func TestConvertContrackEntryToConn(t *testing.T) {
 			},
 			ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &TCP_CONNTRACK_ESTABLISHED}},
 		},
+		{
+			Origin: &ct.IPTuple{
+				Src: parseIP("2001:db8::1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_TCP, SrcPort: portPtr(8080), DstPort: portPtr(8081)},
+				Dst: parseIP("2001:db8::2"),
+			},
+			Reply: &ct.IPTuple{
+				Src: parseIP("2001:db8::2"), Proto: &ct.ProtoTuple{Number: &IPPROTO_TCP, SrcPort: portPtr(8081)},
+				Dst: parseIP("2001:db8::1"),
+			},
+			ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &TCP_CONNTRACK_ESTABLISHED}},
+		},
 	}
 	conns := convertContrackEntryToConn(ctConn)
 
 	assert.Equal(t, []*Conn{
-		{OriginIP: "192.0.2.1", DestIP: "192.0.2.2", State: "CLOSE-WAIT", Protocol: "TCP", OriginPort: 8080, DestPort: 8081},
-		{OriginIP: "192.0.2.1", DestIP: "192.0.2.2", State: "ESTABLISHED", Protocol: "TCP", OriginPort: 8080, DestPort: 8081},
-		{OriginIP: "192.0.2.1", DestIP: "192.0.2.3", State: "SYN-SENT", Protocol: "TCP", OriginPort: 8080, DestPort: 8081},
-		{OriginIP: "192.0.2.50", DestIP: "192.0.2.51", State: "OPEN", Protocol: "UDP", OriginPort: 8080, DestPort: 8081},
-		{OriginIP: "192.0.2.1", DestIP: "172.68.0.1", State: "ESTABLISHED", Protocol: "TCP", OriginPort: 8080, DestPort: 8081},
+		{OriginIP: "192.0.2.1", DestIP: "192.0.2.2", State: "CLOSE-WAIT", Protocol: "TCP", OriginPort: 8080, DestPort: 8081, Family: "ipv4", ReplyOriginIP: "192.0.2.2", ReplyDestIP: "192.0.2.1", ReplyOriginPort: 8081},
+		{OriginIP: "192.0.2.1", DestIP: "192.0.2.2", State: "ESTABLISHED", Protocol: "TCP", OriginPort: 8080, DestPort: 8081, Family: "ipv4", ReplyOriginIP: "192.0.2.2", ReplyDestIP: "192.0.2.1", ReplyOriginPort: 8081},
+		{OriginIP: "192.0.2.1", DestIP: "192.0.2.3", State: "SYN-SENT", Protocol: "TCP", OriginPort: 8080, DestPort: 8081, Family: "ipv4", ReplyOriginIP: "192.0.2.3", ReplyDestIP: "192.0.2.1", ReplyOriginPort: 8081, Start: delayedConnStart},
+		{OriginIP: "192.0.2.50", DestIP: "192.0.2.51", State: "OPEN", Protocol: "UDP", OriginPort: 8080, DestPort: 8081, Family: "ipv4", ReplyOriginIP: "192.0.2.51", ReplyDestIP: "192.0.2.50", ReplyOriginPort: 8081, Zone: 3, Mark: 0x10},
+		{OriginIP: "192.0.2.1", DestIP: "172.68.0.1", State: "ESTABLISHED", Protocol: "TCP", OriginPort: 8080, DestPort: 8081, Family: "ipv4", ReplyOriginIP: "192.0.2.2", ReplyOriginPort: 8081},
+		{OriginIP: "2001:db8::1", DestIP: "2001:db8::2", State: "ESTABLISHED", Protocol: "TCP", OriginPort: 8080, DestPort: 8081, Family: "ipv6", ReplyOriginIP: "2001:db8::2", ReplyDestIP: "2001:db8::1", ReplyOriginPort: 8081},
 	}, conns)
 }
 
@@ -127,3 +144,149 @@ func parseIP(ip string) *net.IP {
 func portPtr(port uint16) *uint16 {
 	return &port
 }
+
+func TestConvertContrackEntryToConnWithTCPStates(t *testing.T) {
+	defer SetTCPStates("")
+	require.NoError(t, SetTCPStates("syn_recv,FIN-WAIT,last-ack"))
+
+	ctConn := []ct.Con{}
+	for _, state := range []uint8{TCP_CONNTRACK_SYN_RECV, TCP_CONNTRACK_ESTABLISHED, TCP_CONNTRACK_FIN_WAIT, TCP_CONNTRACK_LAST_ACK, TCP_CONNTRACK_CLOSE} {
+		state := state
+		ctConn = append(ctConn, ct.Con{
+			Origin: &ct.IPTuple{
+				Src: parseIP("192.0.2.1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_TCP, SrcPort: portPtr(8080), DstPort: portPtr(8081)},
+				Dst: parseIP("192.0.2.2"),
+			},
+			ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &state}},
+		})
+	}
+
+	states := []string{}
+	for _, conn := range convertContrackEntryToConn(ctConn) {
+		states = append(states, conn.State)
+	}
+	assert.Equal(t, []string{"SYN-RECV", "FIN-WAIT", "LAST-ACK"}, states)
+}
+
+func TestSetTCPStates(t *testing.T) {
+	defer SetTCPStates("")
+
+	require.NoError(t, SetTCPStates("ESTABLISHED, close"))
+	assert.Equal(t, map[string]bool{"ESTABLISHED": true, "CLOSE": true}, allowedTCPStates)
+
+	assert.EqualError(t, SetTCPStates("ESTABLISHED,LISTEN"), `unknown TCP state: "LISTEN"`)
+
+	require.NoError(t, SetTCPStates(""))
+	assert.Equal(t, map[string]bool{"ESTABLISHED": true, "CLOSE-WAIT": true, "TIME-WAIT": true, "SYN-SENT": true}, allowedTCPStates)
+}
+
+func TestSetSynSentToleration(t *testing.T) {
+	defer SetSynSentToleration(DefaultSynSentToleration)
+
+	start := time.Now().UTC().Add(-5 * time.Second)
+	entry := ct.Con{
+		Origin: &ct.IPTuple{
+			Src: parseIP("192.0.2.1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_TCP, SrcPort: portPtr(8080), DstPort: portPtr(8081)},
+			Dst: parseIP("192.0.2.3"),
+		},
+		ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &TCP_CONNTRACK_SYN_SENT}},
+		Timestamp: &ct.Timestamp{Start: &start},
+	}
+	assert.Len(t, convertContrackEntryToConn([]ct.Con{entry}), 0)
+
+	require.NoError(t, SetSynSentToleration(time.Second))
+	assert.Len(t, convertContrackEntryToConn([]ct.Con{entry}), 1)
+
+	assert.Error(t, SetSynSentToleration(-time.Second))
+}
+
+func TestConnStatusName(t *testing.T) {
+	assert.Equal(t, "unreplied", (&Conn{}).StatusName())
+	assert.Equal(t, "seen_reply", (&Conn{Status: IPS_SEEN_REPLY}).StatusName())
+	assert.Equal(t, "assured", (&Conn{Status: IPS_SEEN_REPLY | IPS_ASSURED}).StatusName())
+	assert.Equal(t, "dying", (&Conn{Status: IPS_SEEN_REPLY | IPS_ASSURED | IPS_DYING}).StatusName())
+}
+
+func TestAttemptResult(t *testing.T) {
+	assured := IPS_SEEN_REPLY | IPS_ASSURED
+	seenReply := IPS_SEEN_REPLY
+	unreplied := uint32(0)
+
+	tests := []struct {
+		proto    uint8
+		state    *uint8
+		status   *uint32
+		expected string
+	}{
+		{IPPROTO_TCP, &TCP_CONNTRACK_TIME_WAIT, &assured, AttemptEstablished},
+		{IPPROTO_TCP, &TCP_CONNTRACK_SYN_SENT, &unreplied, AttemptTimeout},
+		{IPPROTO_TCP, &TCP_CONNTRACK_SYN_SENT2, nil, AttemptTimeout},
+		{IPPROTO_TCP, &TCP_CONNTRACK_CLOSE, &seenReply, AttemptReset},
+		{IPPROTO_TCP, nil, nil, AttemptReset},
+		{IPPROTO_UDP, nil, &seenReply, AttemptReplied},
+		{IPPROTO_UDP, nil, &unreplied, AttemptUnreplied},
+		{IPPROTO_ICMP, nil, &seenReply, ""},
+	}
+	for _, tt := range tests {
+		proto := tt.proto
+		entry := ct.Con{
+			Origin: &ct.IPTuple{Src: parseIP("192.0.2.1"), Dst: parseIP("192.0.2.2"), Proto: &ct.ProtoTuple{Number: &proto}},
+			Status: tt.status,
+		}
+		if tt.state != nil {
+			entry.ProtoInfo = &ct.ProtoInfo{TCP: &ct.TCPInfo{State: tt.state}}
+		}
+		assert.Equal(t, tt.expected, attemptResult(&entry))
+	}
+}
+
+func TestConvertContrackEntryToConnOtherProtocols(t *testing.T) {
+	echoRequest, echoCode := uint8(8), uint8(0)
+	icmpv6EchoRequest := uint8(128)
+	sctpState := SCTP_CONNTRACK_COOKIE_WAIT
+
+	ctConn := []ct.Con{
+		{
+			Origin: &ct.IPTuple{
+				Src: parseIP("192.0.2.1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_SCTP, SrcPort: portPtr(38412), DstPort: portPtr(38412)},
+				Dst: parseIP("192.0.2.2"),
+			},
+			ProtoInfo: &ct.ProtoInfo{SCTP: &ct.SCTPInfo{State: &sctpState}},
+		},
+		{
+			Origin: &ct.IPTuple{
+				Src: parseIP("192.0.2.1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_SCTP, SrcPort: portPtr(38412), DstPort: portPtr(38412)},
+				Dst: parseIP("192.0.2.2"),
+			},
+		},
+		{
+			Origin: &ct.IPTuple{
+				Src: parseIP("192.0.2.1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_ICMP, IcmpType: &echoRequest, IcmpCode: &echoCode, IcmpID: portPtr(42)},
+				Dst: parseIP("192.0.2.3"),
+			},
+		},
+		{
+			Origin: &ct.IPTuple{
+				Src: parseIP("2001:db8::1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_ICMPV6, Icmpv6Type: &icmpv6EchoRequest, Icmpv6Code: &echoCode},
+				Dst: parseIP("2001:db8::2"),
+			},
+		},
+		{
+			Origin: &ct.IPTuple{
+				Src: parseIP("192.0.2.1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_GRE},
+				Dst: parseIP("192.0.2.4"),
+			},
+		},
+	}
+	conns := convertContrackEntryToConn(ctConn)
+
+	assert.Equal(t, []*Conn{
+		{OriginIP: "192.0.2.1", DestIP: "192.0.2.2", State: "COOKIE-WAIT", Protocol: "SCTP", OriginPort: 38412, DestPort: 38412, Family: "ipv4"},
+		{OriginIP: "192.0.2.1", DestIP: "192.0.2.3", State: "OPEN", Protocol: "ICMP", Family: "ipv4", IcmpType: 8},
+		{OriginIP: "2001:db8::1", DestIP: "2001:db8::2", State: "OPEN", Protocol: "ICMPv6", Family: "ipv6", IcmpType: 128},
+		{OriginIP: "192.0.2.1", DestIP: "192.0.2.4", State: "OPEN", Protocol: "GRE", Family: "ipv4"},
+	}, conns)
+	assert.Equal(t, "", conns[0].ICMP())
+	assert.Equal(t, "type=8 code=0", conns[1].ICMP())
+	assert.Equal(t, "type=128 code=0", conns[2].ICMP())
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tsuru/prometheus-conntrack/workload"
+)
+
+const dnsPort = 53
+
+type dnsFlowKey struct {
+	workload           string
+	resolver           string
+	translatedResolver string
+	protocol           string
+	status             string
+}
+
+// dnsHealth looks at the DNS flows (port 53) of workloads, counting the ones
+// that were replied or not per resolver. Unreplied flows that show up while
+// the insert_failed statistic grows are counted apart, they are the signature
+// of the conntrack insert race that makes DNS queries time out.
+type dnsHealth struct {
+	sync.Mutex
+	dumpCPUStat func() ([]ct.CPUStat, error)
+
+	flows        map[dnsFlowKey]int
+	unreplied    map[uint32]struct{}
+	seen         map[uint32]struct{}
+	newUnreplied uint64
+
+	insertFailed          uint64
+	insertFailedKnown     bool
+	insertFailedUnreplied uint64
+}
+
+func newDNSHealth(cpuStats *CPUStats) *dnsHealth {
+	return &dnsHealth{
+		dumpCPUStat: cpuStats.dump,
+		flows:       map[dnsFlowKey]int{},
+		unreplied:   map[uint32]struct{}{},
+		seen:        map[uint32]struct{}{},
+	}
+}
+
+func isDNSConn(conn *Conn, d, translated destination) bool {
+	if !strings.EqualFold(conn.Protocol, "udp") && !strings.EqualFold(conn.Protocol, "tcp") {
+		return false
+	}
+	return d.port == dnsPort || translated.port == dnsPort
+}
+
+// begin resets the flows, the unreplied ones are kept to find the new ones
+func (h *dnsHealth) begin() {
+	h.flows = map[dnsFlowKey]int{}
+	h.seen = map[uint32]struct{}{}
+	h.newUnreplied = 0
+}
+
+func (h *dnsHealth) track(workload string, conn *Conn, d, translated destination) {
+	if conn.Closed || !isDNSConn(conn, d, translated) {
+		return
+	}
+
+	status := "replied"
+	if conn.Status&IPS_SEEN_REPLY == 0 {
+		status = "unreplied"
+		h.seen[conn.ID] = struct{}{}
+		if _, ok := h.unreplied[conn.ID]; !ok {
+			h.newUnreplied++
+		}
+	}
+
+	key := dnsFlowKey{
+		workload:           workload,
+		resolver:           d.String(),
+		translatedResolver: translated.String(),
+		protocol:           strings.ToUpper(conn.Protocol),
+		status:             status,
+	}
+	h.flows[key] = h.flows[key] + 1
+}
+
+// end finishes the scrape comparing insert_failed with the previous one, the
+// statistics are dumped by the caller before taking the locks
+func (h *dnsHealth) end(stats []ct.CPUStat, err error) {
+	h.unreplied = h.seen
+
+	if err != nil {
+		log.Print(err)
+		h.insertFailedKnown = false
+		return
+	}
+
+	var insertFailed uint64
+	for _, stat := range stats {
+		if stat.InsertFailed != nil {
+			insertFailed += uint64(*stat.InsertFailed)
+		}
+	}
+	if h.insertFailedKnown && insertFailed > h.insertFailed {
+		h.insertFailedUnreplied += h.newUnreplied
+	}
+	h.insertFailed = insertFailed
+	h.insertFailedKnown = true
+}
+
+func (c *ConntrackCollector) workloadDNSFlowsDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, "resolver", "translated_resolver", "protocol", "status")
+
+	return prometheus.NewDesc("conntrack_workload_dns_flows", "Number of workload DNS flows by resolver, replied or not", labels, nil)
+}
+
+var (
+	dnsResolverFlowsDesc     = prometheus.NewDesc("conntrack_dns_resolver_flows", "Number of workload DNS flows by resolver, after DNAT, replied or not", []string{"resolver", "status"}, nil)
+	dnsInsertFailedFlowsDesc = prometheus.NewDesc("conntrack_dns_insert_failed_unreplied_flows_total", "Number of unreplied workload DNS flows that showed up while insert_failed grew", nil, nil)
+)
+
+func (c *ConntrackCollector) describeDNSHealth(ch chan<- *prometheus.Desc) {
+	ch <- c.workloadDNSFlowsDesc()
+	ch <- dnsResolverFlowsDesc
+	ch <- dnsInsertFailedFlowsDesc
+}
+
+func (c *ConntrackCollector) sendDNSHealthMetrics(workloads map[string]*workload.Workload, ch chan<- prometheus.Metric) {
+	c.dnsHealth.Lock()
+	defer c.dnsHealth.Unlock()
+
+	workloadDNSFlowsDesc := c.workloadDNSFlowsDesc()
+	resolverFlows := map[[2]string]int{}
+	for key, count := range c.dnsHealth.flows {
+		resolverFlows[[2]string{key.translatedResolver, key.status}] += count
+
+		workload := workloads[key.workload]
+		if workload == nil {
+			continue
+		}
+		values := []string{workload.Name}
+		for _, k := range c.workloadLabels {
+			values = append(values, workload.Labels[k])
+		}
+		values = append(values, key.resolver, key.translatedResolver, key.protocol, key.status)
+		ch <- prometheus.MustNewConstMetric(workloadDNSFlowsDesc, prometheus.GaugeValue, float64(count), values...)
+	}
+
+	for key, count := range resolverFlows {
+		ch <- prometheus.MustNewConstMetric(dnsResolverFlowsDesc, prometheus.GaugeValue, float64(count), key[0], key[1])
+	}
+
+	if c.dnsHealth.insertFailedKnown {
+		ch <- prometheus.MustNewConstMetric(dnsInsertFailedFlowsDesc, prometheus.CounterValue, float64(c.dnsHealth.insertFailedUnreplied))
+	}
+}
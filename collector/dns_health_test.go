@@ -0,0 +1,63 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"errors"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsDNSConn(t *testing.T) {
+	assert.True(t, isDNSConn(&Conn{Protocol: "UDP"}, destination{ip: "10.96.0.10", port: 53}, destination{ip: "10.2.0.5", port: 53}))
+	assert.True(t, isDNSConn(&Conn{Protocol: "tcp"}, destination{ip: "169.254.20.10", port: 5353}, destination{ip: "10.2.0.5", port: 53}))
+	assert.False(t, isDNSConn(&Conn{Protocol: "SCTP"}, destination{ip: "10.96.0.10", port: 53}, destination{ip: "10.96.0.10", port: 53}))
+	assert.False(t, isDNSConn(&Conn{Protocol: "UDP"}, destination{ip: "10.96.0.10", port: 123}, destination{ip: "10.96.0.10", port: 123}))
+}
+
+func TestDNSHealthInsertFailed(t *testing.T) {
+	var insertFailed uint32
+	var statErr error
+	h := newDNSHealth(NewCPUStats())
+	h.dumpCPUStat = func() ([]ct.CPUStat, error) {
+		return []ct.CPUStat{{ID: 0, InsertFailed: uint32Ptr(insertFailed)}, {ID: 1}}, statErr
+	}
+	d := destination{ip: "10.96.0.10", port: 53}
+	unreplied := func(id uint32) *Conn { return &Conn{ID: id, Protocol: "UDP"} }
+
+	h.begin()
+	h.track("w1", unreplied(1), d, d)
+	h.end(h.dumpCPUStat())
+	assert.Equal(t, uint64(0), h.insertFailedUnreplied)
+
+	// insert_failed grew, connection 2 is new
+	insertFailed = 4
+	h.begin()
+	h.track("w1", unreplied(1), d, d)
+	h.track("w1", unreplied(2), d, d)
+	h.track("w1", &Conn{ID: 3, Protocol: "UDP", Status: IPS_SEEN_REPLY}, d, d)
+	h.track("w1", &Conn{ID: 4, Protocol: "UDP", Closed: true}, d, d)
+	h.end(h.dumpCPUStat())
+	assert.Equal(t, uint64(1), h.insertFailedUnreplied)
+	assert.Equal(t, map[dnsFlowKey]int{
+		{workload: "w1", resolver: "10.96.0.10:53", translatedResolver: "10.96.0.10:53", protocol: "UDP", status: "unreplied"}: 2,
+		{workload: "w1", resolver: "10.96.0.10:53", translatedResolver: "10.96.0.10:53", protocol: "UDP", status: "replied"}:   1,
+	}, h.flows)
+
+	// statistics are not available, the next scrape can't be compared
+	statErr = errors.New("permission denied")
+	h.begin()
+	h.end(h.dumpCPUStat())
+	assert.False(t, h.insertFailedKnown)
+
+	statErr = nil
+	insertFailed = 8
+	h.begin()
+	h.track("w1", unreplied(5), d, d)
+	h.end(h.dumpCPUStat())
+	assert.Equal(t, uint64(1), h.insertFailedUnreplied)
+}
@@ -1,8 +1,10 @@
 package collector
 
 import (
+	"context"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	cache "github.com/patrickmn/go-cache"
@@ -10,6 +12,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+const (
+	DefaultDNSWorkers   = 8
+	DefaultDNSQueueSize = 1024
+	DefaultDNSTimeout   = 2 * time.Second
+)
+
 var (
 	cacheCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "conntrack_dns_cache_calls_total",
@@ -20,18 +28,54 @@ var (
 		Name: "conntrack_dns_error_total",
 		Help: "The number of errors to call DNS",
 	})
+
+	dnsQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "conntrack_dns_queue_depth",
+		Help: "The number of IPs waiting to be resolved",
+	})
+
+	dnsLookupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "conntrack_dns_lookup_duration_seconds",
+		Help:    "The latency of the DNS lookups",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 5},
+	})
 )
 
 type DNSCache interface {
 	ResolveIP(ip string) (addr string)
 }
 
+// dnsCache resolves the names of IPs in background, a miss returns an empty
+// name and queues the IP to a pool of workers, so scrapes never wait for DNS.
 type dnsCache struct {
-	c *cache.Cache
+	c          *cache.Cache
+	timeout    time.Duration
+	lookupAddr func(ctx context.Context, ip string) ([]string, error)
+	queue      chan string
+
+	pendingMutex sync.Mutex
+	pending      map[string]struct{}
+}
+
+// NewDNSCache returns a DNSCache resolving IPs with up to workers concurrent
+// lookups, queueSize bounds the number of IPs waiting to be resolved and
+// timeout bounds each lookup.
+func NewDNSCache(workers, queueSize int, timeout time.Duration) DNSCache {
+	d := newDNSCache(net.DefaultResolver.LookupAddr, queueSize, timeout)
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+	return d
 }
 
-func newDNSCache() *dnsCache {
-	return &dnsCache{c: cache.New(30*time.Minute, time.Minute)}
+func newDNSCache(lookupAddr func(ctx context.Context, ip string) ([]string, error), queueSize int, timeout time.Duration) *dnsCache {
+	return &dnsCache{
+		c:          cache.New(30*time.Minute, time.Minute),
+		timeout:    timeout,
+		lookupAddr: lookupAddr,
+		queue:      make(chan string, queueSize),
+		pending:    map[string]struct{}{},
+	}
 }
 
 func (d *dnsCache) ResolveIP(ip string) string {
@@ -42,17 +86,52 @@ func (d *dnsCache) ResolveIP(ip string) string {
 	}
 
 	cacheCallsTotal.WithLabelValues("miss").Inc()
+	d.enqueue(ip)
+	return ""
+}
 
-	names, err := net.LookupAddr(ip)
+// enqueue queues ip once, when the queue is full ip is left to a next call
+func (d *dnsCache) enqueue(ip string) {
+	d.pendingMutex.Lock()
+	defer d.pendingMutex.Unlock()
+
+	if _, ok := d.pending[ip]; ok {
+		return
+	}
+	select {
+	case d.queue <- ip:
+		d.pending[ip] = struct{}{}
+		dnsQueueDepth.Inc()
+	default:
+		cacheCallsTotal.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (d *dnsCache) worker() {
+	for ip := range d.queue {
+		dnsQueueDepth.Dec()
+		name := d.lookup(ip)
+		d.c.Set(ip, name, cache.DefaultExpiration)
+
+		d.pendingMutex.Lock()
+		delete(d.pending, ip)
+		d.pendingMutex.Unlock()
+	}
+}
+
+func (d *dnsCache) lookup(ip string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	start := time.Now()
+	names, err := d.lookupAddr(ctx, ip)
+	dnsLookupDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
 		dnsErrorTotal.Inc()
 	}
 
-	name := ""
 	if len(names) > 0 {
-		name = strings.TrimRight(names[0], ".")
+		return strings.TrimRight(names[0], ".")
 	}
-
-	d.c.Set(ip, name, cache.DefaultExpiration)
-	return name
+	return ""
 }
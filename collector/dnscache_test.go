@@ -0,0 +1,72 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSCacheResolveIP(t *testing.T) {
+	var mu sync.Mutex
+	lookups := map[string]int{}
+	d := newDNSCache(func(ctx context.Context, ip string) ([]string, error) {
+		mu.Lock()
+		lookups[ip]++
+		mu.Unlock()
+		if ip == "10.0.0.2" {
+			return nil, errors.New("not found")
+		}
+		return []string{"alice-service.default.svc.cluster.local."}, nil
+	}, 10, time.Second)
+
+	assert.Equal(t, "", d.ResolveIP("10.0.0.1"))
+	assert.Equal(t, "", d.ResolveIP("10.0.0.1"))
+	assert.Equal(t, "", d.ResolveIP("10.0.0.2"))
+	assert.Len(t, d.queue, 2)
+
+	go d.worker()
+	require.Eventually(t, func() bool {
+		return d.ResolveIP("10.0.0.1") != ""
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "alice-service.default.svc.cluster.local", d.ResolveIP("10.0.0.1"))
+	require.Eventually(t, func() bool {
+		_, found := d.c.Get("10.0.0.2")
+		return found
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "", d.ResolveIP("10.0.0.2"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"10.0.0.1": 1, "10.0.0.2": 1}, lookups)
+}
+
+func TestDNSCacheQueueFull(t *testing.T) {
+	d := newDNSCache(func(ctx context.Context, ip string) ([]string, error) {
+		return []string{"bob-service."}, nil
+	}, 1, time.Second)
+
+	assert.Equal(t, "", d.ResolveIP("10.0.0.1"))
+	assert.Equal(t, "", d.ResolveIP("10.0.0.2"))
+	assert.Len(t, d.queue, 1)
+	assert.NotContains(t, d.pending, "10.0.0.2")
+}
+
+func TestDNSCacheLookupTimeout(t *testing.T) {
+	d := newDNSCache(func(ctx context.Context, ip string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, 1, 10*time.Millisecond)
+
+	start := time.Now()
+	assert.Equal(t, "", d.lookup("10.0.0.1"))
+	assert.True(t, time.Since(start) < time.Second)
+}
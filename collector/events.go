@@ -0,0 +1,394 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// eventsReadBuffer is the socket buffer used to receive conntrack events,
+// busy nodes generate bursts of events that overflow the default buffer.
+var eventsReadBuffer = 8 * 1024 * 1024
+
+// maxClosedConns limits the closed connections kept between two calls
+var maxClosedConns = 100000
+
+var closedDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "conntrack_closed_connections_dropped_total",
+	Help: "Number of closed connections dropped because too many were kept between two scrapes",
+})
+
+var resubscriptionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "conntrack_events_resubscriptions_total",
+	Help: "Number of times the conntrack events subscription stopped and was subscribed again",
+})
+
+type subscription struct {
+	cancel   context.CancelFunc
+	handlers []*ct.Nfct
+	logs     subscriptionLog
+}
+
+// subscriptionLog receives the logs of the go-conntrack handlers, their
+// receive loop logs and stops on errors that are not temporary.
+type subscriptionLog struct {
+	failed int32
+}
+
+func (l *subscriptionLog) Write(p []byte) (int, error) {
+	if bytes.HasPrefix(p, []byte("receiving error")) {
+		atomic.StoreInt32(&l.failed, 1)
+		log.Printf("Conntrack events subscription stopped: %s", p)
+	}
+	return len(p), nil
+}
+
+func (s *subscription) failed() bool {
+	return atomic.LoadInt32(&s.logs.failed) == 1
+}
+
+func (s *subscription) close() {
+	s.cancel()
+	for _, nfct := range s.handlers {
+		nfct.Close()
+	}
+}
+
+// eventConntrack keeps a flow table updated by conntrack NEW, UPDATE and DESTROY
+// events, it is reconciled with a full dump periodically because the kernel
+// drops events when the socket buffer is full.
+type eventConntrack struct {
+	sync.Mutex
+	protocols []uint8
+	dump      func() ([]ct.Con, error)
+	subscribe func() (*subscription, error)
+	flows     map[uint32]ct.Con
+	// closing holds when the flows were first seen on a closing TCP state
+	closing      map[uint32]time.Time
+	closed       []*Conn
+	closedFull   bool
+	subscription *subscription
+	// resyncing holds the events received while a dump is running, they
+	// are replayed onto the dumped table
+	resyncing *resyncEvents
+}
+
+type resyncEvents struct {
+	updated   map[uint32]ct.Con
+	destroyed map[uint32]struct{}
+}
+
+// NewEventConntrack returns a Conntrack that serves entries from a flow table
+// maintained by conntrack events instead of dumping the table on every call.
+func NewEventConntrack(protocol string, resyncInterval time.Duration) (Conntrack, error) {
+	protocols, err := ParseProtocols(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	e := newEventConntrack(protocols)
+	e.subscription, err = e.subscribe()
+	if err != nil {
+		return nil, err
+	}
+	if err = e.resync(); err != nil {
+		e.subscription.close()
+		return nil, err
+	}
+
+	go e.resyncLoop(resyncInterval)
+	return e.conntrack, nil
+}
+
+func newEventConntrack(protocols []uint8) *eventConntrack {
+	e := &eventConntrack{
+		protocols: protocols,
+		flows:     map[uint32]ct.Con{},
+		closing:   map[uint32]time.Time{},
+	}
+	e.dump = e.dumpEntries
+	e.subscribe = e.subscribeEvents
+	return e
+}
+
+func (e *eventConntrack) dumpEntries() ([]ct.Con, error) {
+	nfct, err := ct.Open(&ct.Config{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create nfct")
+	}
+	defer nfct.Close()
+
+	// go-conntrack discards the connlabels of events, so the dumps drop them too
+	entries, _, err := dumpEntries(nfct, e.protocols)
+	return entries, err
+}
+
+func (e *eventConntrack) conntrack() ([]*Conn, error) {
+	e.Lock()
+	entries := make([]ct.Con, 0, len(e.flows))
+	for _, entry := range e.flows {
+		entries = append(entries, entry)
+	}
+	closing := make(map[uint32]time.Time, len(e.closing))
+	for id, t := range e.closing {
+		closing[id] = t
+	}
+	closed := e.closed
+	e.closed = nil
+	e.closedFull = false
+	e.Unlock()
+
+	conns := convertContrackEntryToConn(entries)
+	for _, conn := range conns {
+		conn.Closing = closing[conn.ID]
+	}
+	return append(conns, closed...), nil
+}
+
+func (e *eventConntrack) resyncLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := e.resync(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// resync replaces the flow table by a full dump. The events received during
+// the dump are replayed onto it, so flows created meanwhile are kept and the
+// ones destroyed are not brought back.
+func (e *eventConntrack) resync() error {
+	if err := e.resubscribe(); err != nil {
+		log.Print(err)
+	}
+
+	e.Lock()
+	e.resyncing = &resyncEvents{updated: map[uint32]ct.Con{}, destroyed: map[uint32]struct{}{}}
+	e.Unlock()
+
+	entries, err := e.dump()
+
+	e.Lock()
+	defer e.Unlock()
+	events := e.resyncing
+	e.resyncing = nil
+	if err != nil {
+		return err
+	}
+
+	flows := make(map[uint32]ct.Con, len(entries))
+	for _, entry := range entries {
+		if entry.ID == nil {
+			continue
+		}
+		if _, ok := events.destroyed[*entry.ID]; ok {
+			continue
+		}
+		flows[*entry.ID] = entry
+	}
+	for id, event := range events.updated {
+		if dumped, ok := flows[id]; ok {
+			flows[id] = mergeEntry(dumped, event)
+		} else if entry, ok := e.flows[id]; ok {
+			// created during the dump, the table has it merged from all events
+			flows[id] = entry
+		}
+	}
+	e.flows = flows
+
+	now := time.Now().UTC()
+	closing := map[uint32]time.Time{}
+	for id, entry := range flows {
+		if t, ok := e.closing[id]; ok {
+			closing[id] = t
+		} else if isClosingEntry(&entry) {
+			closing[id] = now
+		}
+	}
+	e.closing = closing
+
+	return nil
+}
+
+// resubscribe replaces a subscription whose handlers stopped receiving
+// events, the events missed meanwhile are recovered by the resync dump.
+func (e *eventConntrack) resubscribe() error {
+	if e.subscription == nil || !e.subscription.failed() {
+		return nil
+	}
+
+	e.subscription.close()
+	sub, err := e.subscribe()
+	if err != nil {
+		return err
+	}
+	e.subscription = sub
+	resubscriptionsTotal.Inc()
+	return nil
+}
+
+func (e *eventConntrack) subscribeEvents() (*subscription, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := &subscription{cancel: cancel}
+	logger := log.New(&sub.logs, "", 0)
+
+	groups := []struct {
+		group ct.NetlinkGroup
+		fn    ct.HookFunc
+	}{
+		{ct.NetlinkCtNew | ct.NetlinkCtUpdate, e.update},
+		{ct.NetlinkCtDestroy, e.destroy},
+	}
+
+	filter := []ct.ConnAttr{}
+	for _, proto := range e.protocols {
+		filter = append(filter, ct.ConnAttr{Type: ct.AttrOrigL4Proto, Data: []byte{proto}})
+	}
+
+	for _, g := range groups {
+		nfct, err := ct.Open(&ct.Config{Logger: logger})
+		if err != nil {
+			sub.close()
+			return nil, errors.Wrap(err, "Could not create nfct")
+		}
+		sub.handlers = append(sub.handlers, nfct)
+
+		if err = nfct.Con.SetReadBuffer(eventsReadBuffer); err != nil {
+			log.Printf("Could not set conntrack events read buffer, err: %s", err.Error())
+		}
+		// missed events are recovered on the next resync
+		if err = nfct.Con.SetOption(netlink.NoENOBUFS, true); err != nil {
+			log.Printf("Could not disable ENOBUFS on conntrack events, err: %s", err.Error())
+		}
+
+		if len(filter) > 0 {
+			err = nfct.RegisterFiltered(ctx, ct.Conntrack, g.group, filter, g.fn)
+		} else {
+			err = nfct.Register(ctx, ct.Conntrack, g.group, g.fn)
+		}
+		if err != nil {
+			sub.close()
+			return nil, errors.Wrap(err, "Could not subscribe to conntrack events")
+		}
+	}
+
+	return sub, nil
+}
+
+func (e *eventConntrack) update(entry ct.Con) int {
+	if entry.ID == nil {
+		return 0
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	if e.resyncing != nil {
+		event := entry
+		if previous, ok := e.resyncing.updated[*entry.ID]; ok {
+			event = mergeEntry(previous, event)
+		}
+		e.resyncing.updated[*entry.ID] = event
+	}
+	if previous, ok := e.flows[*entry.ID]; ok {
+		entry = mergeEntry(previous, entry)
+	}
+	// the kernel may send partial UPDATE events of entries that are not
+	// known yet, they can't be converted without the tuple
+	if entry.Origin == nil || entry.Origin.Proto == nil || entry.Origin.Proto.Number == nil {
+		return 0
+	}
+	e.flows[*entry.ID] = entry
+	if _, ok := e.closing[*entry.ID]; !ok && isClosingEntry(&entry) {
+		e.closing[*entry.ID] = time.Now().UTC()
+	}
+	return 0
+}
+
+func (e *eventConntrack) destroy(entry ct.Con) int {
+	if entry.ID == nil {
+		return 0
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	if previous, ok := e.flows[*entry.ID]; ok {
+		entry = mergeEntry(previous, entry)
+		delete(e.flows, *entry.ID)
+	}
+	closing := e.closing[*entry.ID]
+	delete(e.closing, *entry.ID)
+	if e.resyncing != nil {
+		delete(e.resyncing.updated, *entry.ID)
+		e.resyncing.destroyed[*entry.ID] = struct{}{}
+	}
+
+	if len(e.closed) >= maxClosedConns {
+		if !e.closedFull {
+			log.Printf("Reached %d closed connections, dropping them until the next scrape", maxClosedConns)
+			e.closedFull = true
+		}
+		closedDroppedTotal.Inc()
+		return 0
+	}
+	if conn := convertClosedEntryToConn(&entry); conn != nil {
+		conn.Closing = closing
+		e.closed = append(e.closed, conn)
+	}
+	return 0
+}
+
+func isClosingEntry(entry *ct.Con) bool {
+	if entry.ProtoInfo == nil || entry.ProtoInfo.TCP == nil || entry.ProtoInfo.TCP.State == nil {
+		return false
+	}
+	_, ok := closingStates[tcpStateNames[*entry.ProtoInfo.TCP.State]]
+	return ok
+}
+
+// mergeEntry fills the attributes that the kernel omits on UPDATE events
+// (ie: counters and timestamps) with the ones already known.
+func mergeEntry(previous, current ct.Con) ct.Con {
+	if current.Origin == nil {
+		current.Origin = previous.Origin
+	}
+	if current.Reply == nil {
+		current.Reply = previous.Reply
+	}
+	if current.ProtoInfo == nil {
+		current.ProtoInfo = previous.ProtoInfo
+	}
+	if current.CounterOrigin == nil {
+		current.CounterOrigin = previous.CounterOrigin
+	}
+	if current.CounterReply == nil {
+		current.CounterReply = previous.CounterReply
+	}
+	if current.Status == nil {
+		current.Status = previous.Status
+	}
+	if current.Mark == nil {
+		current.Mark = previous.Mark
+	}
+	if current.Zone == nil {
+		current.Zone = previous.Zone
+	}
+	if current.Timestamp == nil {
+		current.Timestamp = previous.Timestamp
+	}
+	return current
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tcpEntry(id uint32, state uint8) ct.Con {
+	return ct.Con{
+		ID: &id,
+		Origin: &ct.IPTuple{
+			Src: parseIP("192.0.2.1"), Proto: &ct.ProtoTuple{Number: &IPPROTO_TCP, SrcPort: portPtr(8080), DstPort: portPtr(8081)},
+			Dst: parseIP("192.0.2.2"),
+		},
+		Reply: &ct.IPTuple{
+			Src: parseIP("192.0.2.2"), Proto: &ct.ProtoTuple{Number: &IPPROTO_TCP, SrcPort: portPtr(8081)},
+			Dst: parseIP("192.0.2.1"),
+		},
+		ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &state}},
+	}
+}
+
+func TestEventConntrack(t *testing.T) {
+	e := newEventConntrack(nil)
+
+	e.update(tcpEntry(1, TCP_CONNTRACK_ESTABLISHED))
+	e.update(tcpEntry(2, TCP_CONNTRACK_ESTABLISHED))
+	e.update(ct.Con{})
+	partial := tcpEntry(3, TCP_CONNTRACK_ESTABLISHED)
+	partial.Origin = nil
+	e.update(partial)
+
+	conns, err := e.conntrack()
+	require.NoError(t, err)
+	assert.Len(t, conns, 2)
+
+	closeWait := tcpEntry(1, TCP_CONNTRACK_CLOSE_WAIT)
+	closeWait.Origin = nil
+	e.update(closeWait)
+	e.destroy(tcpEntry(2, TCP_CONNTRACK_ESTABLISHED))
+
+	conns, err = e.conntrack()
+	require.NoError(t, err)
+	require.Len(t, conns, 2)
+	assert.False(t, conns[0].Closing.IsZero())
+	conns[0].Closing = time.Time{}
+	assert.Equal(t, []*Conn{
+		{ID: 1, OriginIP: "192.0.2.1", DestIP: "192.0.2.2", State: "CLOSE-WAIT", Protocol: "TCP", OriginPort: 8080, DestPort: 8081, Family: "ipv4", ReplyOriginIP: "192.0.2.2", ReplyDestIP: "192.0.2.1", ReplyOriginPort: 8081},
+		{ID: 2, OriginIP: "192.0.2.1", DestIP: "192.0.2.2", State: "CLOSED", Protocol: "TCP", OriginPort: 8080, DestPort: 8081, Family: "ipv4", ReplyOriginIP: "192.0.2.2", ReplyDestIP: "192.0.2.1", ReplyOriginPort: 8081, AttemptResult: "reset", Closed: true},
+	}, conns)
+}
+
+func TestEventConntrackClosedConnections(t *testing.T) {
+	e := newEventConntrack(nil)
+	established := tcpEntry(1, TCP_CONNTRACK_ESTABLISHED)
+	status := IPS_SEEN_REPLY | IPS_ASSURED
+	established.Status = &status
+	e.update(established)
+
+	originBytes, replyBytes := uint64(300), uint64(1200)
+	destroyed := ct.Con{
+		ID:            tcpEntry(1, 0).ID,
+		CounterOrigin: &ct.Counter{Bytes: &originBytes},
+		CounterReply:  &ct.Counter{Bytes: &replyBytes},
+	}
+	e.destroy(destroyed)
+
+	conns, err := e.conntrack()
+	require.NoError(t, err)
+	assert.Equal(t, []*Conn{
+		{ID: 1, OriginIP: "192.0.2.1", DestIP: "192.0.2.2", State: "CLOSED", Protocol: "TCP", OriginPort: 8080, DestPort: 8081, Family: "ipv4", ReplyOriginIP: "192.0.2.2", ReplyDestIP: "192.0.2.1", ReplyOriginPort: 8081, OriginBytes: 300, ReplyBytes: 1200, Status: IPS_SEEN_REPLY | IPS_ASSURED, AttemptResult: "established", Closed: true},
+	}, conns)
+
+	conns, err = e.conntrack()
+	require.NoError(t, err)
+	assert.Empty(t, conns)
+}
+
+func TestEventConntrackClosedOverflow(t *testing.T) {
+	defer func(max int) { maxClosedConns = max }(maxClosedConns)
+	maxClosedConns = 1
+	e := newEventConntrack(nil)
+	dropped := testutil.ToFloat64(closedDroppedTotal)
+
+	e.destroy(tcpEntry(1, TCP_CONNTRACK_ESTABLISHED))
+	e.destroy(tcpEntry(2, TCP_CONNTRACK_ESTABLISHED))
+	e.destroy(tcpEntry(3, TCP_CONNTRACK_ESTABLISHED))
+	assert.Equal(t, dropped+2, testutil.ToFloat64(closedDroppedTotal))
+	assert.True(t, e.closedFull)
+
+	conns, err := e.conntrack()
+	require.NoError(t, err)
+	require.Len(t, conns, 1)
+	assert.Equal(t, uint32(1), conns[0].ID)
+	assert.False(t, e.closedFull)
+}
+
+func TestMergeEntry(t *testing.T) {
+	bytes := uint64(100)
+	previous := tcpEntry(1, TCP_CONNTRACK_ESTABLISHED)
+	previous.CounterOrigin = &ct.Counter{Bytes: &bytes}
+
+	current := ct.Con{ID: previous.ID, ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &TCP_CONNTRACK_TIME_WAIT}}}
+	merged := mergeEntry(previous, current)
+
+	assert.Equal(t, previous.Origin, merged.Origin)
+	assert.Equal(t, previous.CounterOrigin, merged.CounterOrigin)
+	assert.Equal(t, TCP_CONNTRACK_TIME_WAIT, *merged.ProtoInfo.TCP.State)
+}
+
+func TestEventConntrackResync(t *testing.T) {
+	e := newEventConntrack(nil)
+	e.update(tcpEntry(1, TCP_CONNTRACK_ESTABLISHED))
+	e.update(tcpEntry(2, TCP_CONNTRACK_ESTABLISHED))
+
+	originBytes := uint64(100)
+	e.dump = func() ([]ct.Con, error) {
+		// events received while the table is dumped
+		e.update(tcpEntry(3, TCP_CONNTRACK_SYN_RECV))
+		e.destroy(tcpEntry(2, TCP_CONNTRACK_ESTABLISHED))
+		closeWait := tcpEntry(1, TCP_CONNTRACK_CLOSE_WAIT)
+		closeWait.Origin = nil
+		e.update(closeWait)
+
+		dumped1 := tcpEntry(1, TCP_CONNTRACK_ESTABLISHED)
+		dumped1.CounterOrigin = &ct.Counter{Bytes: &originBytes}
+		return []ct.Con{dumped1, tcpEntry(2, TCP_CONNTRACK_ESTABLISHED), tcpEntry(4, TCP_CONNTRACK_ESTABLISHED)}, nil
+	}
+	require.NoError(t, e.resync())
+	assert.Nil(t, e.resyncing)
+
+	require.Len(t, e.flows, 3)
+	assert.Equal(t, TCP_CONNTRACK_CLOSE_WAIT, *e.flows[1].ProtoInfo.TCP.State)
+	assert.Equal(t, uint64(100), *e.flows[1].CounterOrigin.Bytes)
+	assert.Equal(t, TCP_CONNTRACK_SYN_RECV, *e.flows[3].ProtoInfo.TCP.State)
+	assert.Contains(t, e.flows, uint32(4))
+	assert.NotContains(t, e.flows, uint32(2))
+
+	e.dump = func() ([]ct.Con, error) {
+		return nil, errors.New("permission denied")
+	}
+	assert.Error(t, e.resync())
+	assert.Nil(t, e.resyncing)
+	assert.Len(t, e.flows, 3)
+}
+
+func TestEventConntrackResubscribe(t *testing.T) {
+	e := newEventConntrack(nil)
+	e.dump = func() ([]ct.Con, error) {
+		return nil, nil
+	}
+	subscribed := 0
+	e.subscribe = func() (*subscription, error) {
+		subscribed++
+		return &subscription{cancel: func() {}}, nil
+	}
+	e.subscription, _ = e.subscribe()
+	before := testutil.ToFloat64(resubscriptionsTotal)
+
+	require.NoError(t, e.resync())
+	assert.Equal(t, 1, subscribed)
+
+	failed := e.subscription
+	log.New(&failed.logs, "", 0).Printf("receiving error: %v", errors.New("no buffer space available"))
+	require.NoError(t, e.resync())
+	assert.Equal(t, 2, subscribed)
+	assert.NotSame(t, failed, e.subscription)
+	assert.False(t, e.subscription.failed())
+	assert.Equal(t, before+1, testutil.ToFloat64(resubscriptionsTotal))
+}
+
+func TestEventConntrackClosing(t *testing.T) {
+	e := newEventConntrack(nil)
+	e.update(tcpEntry(1, TCP_CONNTRACK_ESTABLISHED))
+	e.update(tcpEntry(2, TCP_CONNTRACK_ESTABLISHED))
+	assert.Empty(t, e.closing)
+
+	e.update(tcpEntry(1, TCP_CONNTRACK_FIN_WAIT))
+	closing := e.closing[1]
+	assert.False(t, closing.IsZero())
+	// the first closing state is kept
+	e.update(tcpEntry(1, TCP_CONNTRACK_TIME_WAIT))
+	assert.Equal(t, closing, e.closing[1])
+
+	e.destroy(tcpEntry(1, TCP_CONNTRACK_TIME_WAIT))
+	assert.Empty(t, e.closing)
+	conns, err := e.conntrack()
+	require.NoError(t, err)
+	require.Len(t, conns, 2)
+	assert.True(t, conns[0].Closing.IsZero())
+	assert.True(t, conns[1].Closed)
+	assert.Equal(t, closing, conns[1].Closing)
+
+	// entries dumped on a closing state are closing since the resync
+	e.dump = func() ([]ct.Con, error) {
+		return []ct.Con{tcpEntry(2, TCP_CONNTRACK_LAST_ACK)}, nil
+	}
+	require.NoError(t, e.resync())
+	assert.Contains(t, e.closing, uint32(2))
+}
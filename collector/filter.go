@@ -0,0 +1,214 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+)
+
+var (
+	// copied from: https://github.com/torvalds/linux/blob/master/include/uapi/linux/netfilter/nfnetlink_conntrack.h
+	IPCTNL_MSG_CT_GET         uint16 = 1
+	CTA_TUPLE_ORIG            uint16 = 1
+	CTA_FILTER                uint16 = 25
+	CTA_TUPLE_PROTO           uint16 = 2
+	CTA_PROTO_NUM             uint16 = 1
+	CTA_FILTER_ORIG_FLAGS     uint16 = 1
+	CTA_FILTER_REPLY_FLAGS    uint16 = 2
+	CTA_FILTER_FLAG_PROTO_NUM uint32 = 1 << 3
+	CTA_LABELS                uint16 = 22
+
+	// copied from: https://github.com/torvalds/linux/blob/master/include/uapi/linux/netfilter/nfnetlink.h
+	NFNL_SUBSYS_CTNETLINK uint16 = 1
+	NFNETLINK_V0          uint8  = 0
+)
+
+// nfgenmsg header which prefixes every conntrack netlink message
+const nfgenmsgSize = 4
+
+var protocolNumbers = map[string]uint8{
+	"tcp":    IPPROTO_TCP,
+	"udp":    IPPROTO_UDP,
+	"sctp":   IPPROTO_SCTP,
+	"icmp":   IPPROTO_ICMP,
+	"icmpv6": IPPROTO_ICMPV6,
+	"gre":    IPPROTO_GRE,
+}
+
+var discardLogger = log.New(io.Discard, "", 0)
+
+// filterIgnored is set once a dump shows that the kernel ignores CTA_FILTER
+// (older than 5.8), the table is then dumped once per family and filtered by
+// the exporter.
+var filterIgnored int32
+
+// ParseProtocols converts a comma separated list of protocol names (ie: tcp,udp)
+// into protocol numbers, an empty string means all protocols.
+func ParseProtocols(protocol string) ([]uint8, error) {
+	protocols := []uint8{}
+	if protocol == "" {
+		return protocols, nil
+	}
+
+	seen := map[uint8]bool{}
+	for _, name := range strings.Split(protocol, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		number, ok := protocolNumbers[name]
+		if !ok {
+			return nil, errors.Errorf("unknown protocol: %q", name)
+		}
+		if seen[number] {
+			continue
+		}
+		seen[number] = true
+		protocols = append(protocols, number)
+	}
+
+	return protocols, nil
+}
+
+func dumpProtocols(nfct *ct.Nfct, family ct.Family, protocols []uint8, labels connLabels) ([]ct.Con, error) {
+	return dumpFiltered(protocols, func(proto uint8) ([]ct.Con, error) {
+		return dumpProtocol(nfct, family, proto, labels)
+	}, func() ([]ct.Con, error) {
+		return dumpTable(nfct, family, labels)
+	})
+}
+
+// dumpFiltered dumps the entries of each protocol with dumpProtocol, until
+// an entry of another protocol shows that the filter was ignored. From then on
+// dumpAll is used and the entries are filtered here.
+func dumpFiltered(protocols []uint8, dumpProtocol func(proto uint8) ([]ct.Con, error), dumpAll func() ([]ct.Con, error)) ([]ct.Con, error) {
+	if atomic.LoadInt32(&filterIgnored) == 0 {
+		entries := []ct.Con{}
+		for _, proto := range protocols {
+			protoEntries, err := dumpProtocol(proto)
+			if err != nil {
+				return nil, err
+			}
+			if len(filterProtocols(protoEntries, []uint8{proto})) != len(protoEntries) {
+				log.Print("The kernel ignores conntrack dump filters, filtering the entries by protocol on the exporter")
+				atomic.StoreInt32(&filterIgnored, 1)
+				// the whole table was dumped, it has the entries of every protocol
+				return filterProtocols(protoEntries, protocols), nil
+			}
+			entries = append(entries, protoEntries...)
+		}
+		return entries, nil
+	}
+
+	entries, err := dumpAll()
+	if err != nil {
+		return nil, err
+	}
+	return filterProtocols(entries, protocols), nil
+}
+
+func dumpProtocol(nfct *ct.Nfct, family ct.Family, proto uint8, labels connLabels) ([]ct.Con, error) {
+	req, err := protocolDumpRequest(family, proto)
+	if err != nil {
+		return nil, err
+	}
+	return executeDump(nfct, req, labels)
+}
+
+// dumpTable dumps all the entries of family, as nfct.Dump does, keeping the
+// connlabels discarded by go-conntrack.
+func dumpTable(nfct *ct.Nfct, family ct.Family, labels connLabels) ([]ct.Con, error) {
+	return executeDump(nfct, dumpRequest(family, nil), labels)
+}
+
+// executeDump sends a dump request and parses the entries of the replies,
+// their connlabels are added to labels.
+func executeDump(nfct *ct.Nfct, req netlink.Message, labels connLabels) ([]ct.Con, error) {
+	replies, err := nfct.Con.Execute(req)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []ct.Con{}
+	for _, msg := range replies {
+		if len(msg.Data) < nfgenmsgSize {
+			continue
+		}
+		entry, err := ct.ParseAttributes(discardLogger, msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		entryLabels, err := netlinkConnLabels(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		if entryLabels != "" && entry.ID != nil {
+			labels[*entry.ID] = entryLabels
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// filterProtocols keeps the entries whose original tuple is of one of the
+// given protocols.
+func filterProtocols(entries []ct.Con, protocols []uint8) []ct.Con {
+	filtered := []ct.Con{}
+	for _, entry := range entries {
+		if entry.Origin == nil || entry.Origin.Proto == nil || entry.Origin.Proto.Number == nil {
+			continue
+		}
+		for _, proto := range protocols {
+			if *entry.Origin.Proto.Number == proto {
+				filtered = append(filtered, entry)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// protocolDumpRequest builds a conntrack dump request which asks the kernel
+// to only send entries matching the layer 4 protocol of the original tuple.
+func protocolDumpRequest(family ct.Family, proto uint8) (netlink.Message, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Nested(CTA_TUPLE_ORIG, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(CTA_TUPLE_PROTO, func(nae *netlink.AttributeEncoder) error {
+			nae.Uint8(CTA_PROTO_NUM, proto)
+			return nil
+		})
+		return nil
+	})
+	ae.Nested(CTA_FILTER, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint32(CTA_FILTER_ORIG_FLAGS, CTA_FILTER_FLAG_PROTO_NUM)
+		nae.Uint32(CTA_FILTER_REPLY_FLAGS, 0)
+		return nil
+	})
+
+	attrs, err := ae.Encode()
+	if err != nil {
+		return netlink.Message{}, errors.Wrap(err, "Could not encode conntrack filter")
+	}
+
+	return dumpRequest(family, attrs), nil
+}
+
+// dumpRequest builds a conntrack dump request of family with the given
+// encoded attributes.
+func dumpRequest(family ct.Family, attrs []byte) netlink.Message {
+	data := []byte{uint8(family), NFNETLINK_V0, 0, 0}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(NFNL_SUBSYS_CTNETLINK<<8 | IPCTNL_MSG_CT_GET),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: append(data, attrs...),
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProtocols(t *testing.T) {
+	protocols, err := ParseProtocols("")
+	require.NoError(t, err)
+	assert.Empty(t, protocols)
+
+	protocols, err = ParseProtocols("tcp, UDP,sctp,tcp")
+	require.NoError(t, err)
+	assert.Equal(t, []uint8{IPPROTO_TCP, IPPROTO_UDP, IPPROTO_SCTP}, protocols)
+
+	_, err = ParseProtocols("tcp,quic")
+	assert.EqualError(t, err, `unknown protocol: "quic"`)
+}
+
+func TestNewConntrackInvalidProtocol(t *testing.T) {
+	_, err := NewConntrack("tcp,foo")
+	assert.Error(t, err)
+}
+
+func TestProtocolDumpRequest(t *testing.T) {
+	req, err := protocolDumpRequest(ct.IPv4, IPPROTO_TCP)
+	require.NoError(t, err)
+
+	assert.Equal(t, netlink.HeaderType(NFNL_SUBSYS_CTNETLINK<<8|IPCTNL_MSG_CT_GET), req.Header.Type)
+	assert.Equal(t, netlink.Request|netlink.Dump, req.Header.Flags)
+	assert.Equal(t, []byte{uint8(ct.IPv4), NFNETLINK_V0, 0, 0}, req.Data[:nfgenmsgSize])
+
+	var protoNum uint8
+	var origFlags, replyFlags uint32
+	ad, err := netlink.NewAttributeDecoder(req.Data[nfgenmsgSize:])
+	require.NoError(t, err)
+	for ad.Next() {
+		switch ad.Type() {
+		case CTA_TUPLE_ORIG:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() != CTA_TUPLE_PROTO {
+						continue
+					}
+					nad.Nested(func(nad *netlink.AttributeDecoder) error {
+						for nad.Next() {
+							if nad.Type() == CTA_PROTO_NUM {
+								protoNum = nad.Uint8()
+							}
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		case CTA_FILTER:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case CTA_FILTER_ORIG_FLAGS:
+						origFlags = nad.Uint32()
+					case CTA_FILTER_REPLY_FLAGS:
+						replyFlags = nad.Uint32()
+					}
+				}
+				return nil
+			})
+		}
+	}
+	require.NoError(t, ad.Err())
+
+	assert.Equal(t, IPPROTO_TCP, protoNum)
+	assert.Equal(t, CTA_FILTER_FLAG_PROTO_NUM, origFlags)
+	assert.Equal(t, uint32(0), replyFlags)
+}
+
+func protoEntry(proto uint8) ct.Con {
+	return ct.Con{Origin: &ct.IPTuple{Proto: &ct.ProtoTuple{Number: &proto}}}
+}
+
+func TestDumpFiltered(t *testing.T) {
+	defer atomic.StoreInt32(&filterIgnored, 0)
+	table := []ct.Con{protoEntry(IPPROTO_TCP), protoEntry(IPPROTO_UDP), protoEntry(IPPROTO_ICMP), {}}
+	dumpAllCalls := 0
+	dumpAll := func() ([]ct.Con, error) {
+		dumpAllCalls++
+		return table, nil
+	}
+
+	// the kernel honors the filter
+	protocolCalls := 0
+	entries, err := dumpFiltered([]uint8{IPPROTO_TCP, IPPROTO_UDP}, func(proto uint8) ([]ct.Con, error) {
+		protocolCalls++
+		return filterProtocols(table, []uint8{proto}), nil
+	}, dumpAll)
+	require.NoError(t, err)
+	assert.Equal(t, []ct.Con{protoEntry(IPPROTO_TCP), protoEntry(IPPROTO_UDP)}, entries)
+	assert.Equal(t, 2, protocolCalls)
+	assert.Equal(t, 0, dumpAllCalls)
+
+	// the kernel ignores the filter, the first dump is enough
+	protocolCalls = 0
+	ignoring := func(proto uint8) ([]ct.Con, error) {
+		protocolCalls++
+		return table, nil
+	}
+	entries, err = dumpFiltered([]uint8{IPPROTO_TCP, IPPROTO_UDP}, ignoring, dumpAll)
+	require.NoError(t, err)
+	assert.Equal(t, []ct.Con{protoEntry(IPPROTO_TCP), protoEntry(IPPROTO_UDP)}, entries)
+	assert.Equal(t, 1, protocolCalls)
+
+	// from then on the table is dumped once
+	entries, err = dumpFiltered([]uint8{IPPROTO_UDP, IPPROTO_ICMP}, ignoring, dumpAll)
+	require.NoError(t, err)
+	assert.Equal(t, []ct.Con{protoEntry(IPPROTO_UDP), protoEntry(IPPROTO_ICMP)}, entries)
+	assert.Equal(t, 1, protocolCalls)
+	assert.Equal(t, 1, dumpAllCalls)
+
+	_, err = dumpFiltered([]uint8{IPPROTO_TCP}, ignoring, func() ([]ct.Con, error) {
+		return nil, errors.New("permission denied")
+	})
+	assert.Error(t, err)
+}
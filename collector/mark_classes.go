@@ -0,0 +1,55 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LoadMarkClasses reads a file mapping conntrack marks to class names, one
+// mapping per line, ie:
+//
+//	# marks set by CONNMARK rules
+//	0x1=egress-proxy
+//	2=vpn
+func LoadMarkClasses(path string) (map[uint32]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open mark classes file")
+	}
+	defer f.Close()
+
+	classes := map[uint32]string{}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyPair := strings.SplitN(line, "=", 2)
+		if len(keyPair) != 2 || strings.TrimSpace(keyPair[1]) == "" {
+			return nil, errors.Errorf("invalid mark class at line %d: %q", lineNumber, line)
+		}
+
+		mark, err := strconv.ParseUint(strings.TrimSpace(keyPair[0]), 0, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid mark at line %d", lineNumber)
+		}
+		classes[uint32(mark)] = strings.TrimSpace(keyPair[1])
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Could not read mark classes file")
+	}
+
+	return classes, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMarkClasses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "marks")
+	err := os.WriteFile(path, []byte("# marks set by CONNMARK rules\n\n0x1=egress-proxy\n 2 = vpn \n"), 0644)
+	require.NoError(t, err)
+
+	classes, err := LoadMarkClasses(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[uint32]string{1: "egress-proxy", 2: "vpn"}, classes)
+}
+
+func TestLoadMarkClassesInvalid(t *testing.T) {
+	for _, content := range []string{"1", "1=", "abc=vpn", "0x100000000=vpn"} {
+		path := filepath.Join(t.TempDir(), "marks")
+		err := os.WriteFile(path, []byte(content), 0644)
+		require.NoError(t, err)
+
+		_, err = LoadMarkClasses(path)
+		assert.Error(t, err, content)
+	}
+
+	_, err := LoadMarkClasses(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"os"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/pkg/errors"
+)
+
+// NetNSConntrack returns the connections of the conntrack table of the
+// network namespace at netns (ie: /proc/<pid>/ns/net).
+type NetNSConntrack func(netns string) ([]*Conn, error)
+
+// NewNetNSConntrack returns a NetNSConntrack that dumps the table of each
+// namespace, it requires CAP_SYS_ADMIN to enter the namespaces.
+func NewNetNSConntrack(protocol string) (NetNSConntrack, error) {
+	protocols, err := ParseProtocols(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(netns string) ([]*Conn, error) {
+		return netnsConntrack(netns, protocols)
+	}, nil
+}
+
+func netnsConntrack(netns string, protocols []uint8) ([]*Conn, error) {
+	f, err := os.Open(netns)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open network namespace")
+	}
+	defer f.Close()
+
+	nfct, err := ct.Open(&ct.Config{NetNS: int(f.Fd())})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not create nfct on network namespace %s", netns)
+	}
+	defer nfct.Close()
+
+	entries, labels, err := dumpEntries(nfct, protocols)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := convertContrackEntryToConn(entries)
+	labels.apply(conns)
+	return conns, nil
+}
@@ -0,0 +1,312 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"bufio"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/pkg/errors"
+)
+
+// DefaultConntrackFile is the procfs file with the conntrack table of the
+// network namespace of the exporter.
+const DefaultConntrackFile = "/proc/net/nf_conntrack"
+
+// errUnknownState is returned for entries on a state this exporter does not
+// know, they are skipped instead of failing the whole table.
+var errUnknownState = errors.New("unknown state")
+
+var (
+	procTCPStates  = stateNumbers(tcpStateNames)
+	procSCTPStates = stateNumbers(sctpStateNames)
+)
+
+func stateNumbers(names map[uint8]string) map[string]uint8 {
+	numbers := map[string]uint8{}
+	for number, name := range names {
+		numbers[name] = number
+	}
+	return numbers
+}
+
+// NewFileConntrack returns a Conntrack that parses the procfs text format of
+// the conntrack table from path (ie: /proc/net/nf_conntrack or a captured
+// copy of it), only the given protocols (ie: tcp,udp) are returned.
+func NewFileConntrack(path, protocol string) (Conntrack, error) {
+	protocols, err := ParseProtocols(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() ([]*Conn, error) {
+		return fileConntrack(path, protocols)
+	}, nil
+}
+
+func fileConntrack(path string, protocols []uint8) ([]*Conn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open conntrack file")
+	}
+	defer f.Close()
+
+	entries, labels, err := parseConntrackFile(f, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(protocols) > 0 {
+		filtered := entries[:0]
+		for _, entry := range entries {
+			for _, proto := range protocols {
+				if *entry.Origin.Proto.Number == proto {
+					filtered = append(filtered, entry)
+					break
+				}
+			}
+		}
+		entries = filtered
+	}
+
+	conns := convertContrackEntryToConn(entries)
+	labels.apply(conns)
+	return conns, nil
+}
+
+// parseConntrackFile parses entries such as:
+//
+//	ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.1 dst=10.0.0.2 sport=33404 dport=443 packets=10 bytes=1000 src=10.0.0.2 dst=10.0.0.1 sport=443 dport=33404 packets=8 bytes=2000 [ASSURED] mark=0 zone=3 labels=02000000000000000000000000000000 delta-time=120 use=1
+//
+// entries start time is computed from delta-time, relative to now.
+func parseConntrackFile(r io.Reader, now time.Time) ([]ct.Con, connLabels, error) {
+	entries := []ct.Con{}
+	labels := connLabels{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	unknownStates := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		entry, err := parseConntrackLine(line, now, labels)
+		if errors.Cause(err) == errUnknownState {
+			unknownStates++
+			continue
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid conntrack entry at line %d", lineNumber)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "Could not read conntrack file")
+	}
+	if unknownStates > 0 {
+		log.Printf("Skipped %d conntrack entries with unknown states", unknownStates)
+	}
+
+	return entries, labels, nil
+}
+
+// parseConntrackLine parses an entry of the conntrack table, its connlabels
+// are added to labels.
+func parseConntrackLine(line string, now time.Time, labels connLabels) (ct.Con, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return ct.Con{}, errors.Errorf("too few fields: %q", line)
+	}
+
+	l4proto, err := strconv.ParseUint(fields[3], 10, 8)
+	if err != nil {
+		return ct.Con{}, errors.Wrapf(err, "invalid protocol number %q", fields[3])
+	}
+	proto := uint8(l4proto)
+
+	status := IPS_SEEN_REPLY
+	entry := ct.Con{Status: &status}
+	tuples := []*ct.IPTuple{}
+	counters := []*ct.Counter{}
+	entryLabels := ""
+	// the kernel does not expose the entry id, a hash of the origin tuple
+	// identifies the connection between reads instead
+	id := fnv.New32a()
+	id.Write([]byte(fields[1] + " " + fields[3]))
+
+	for _, field := range fields[5:] {
+		switch field {
+		case "[UNREPLIED]":
+			status &^= IPS_SEEN_REPLY
+			continue
+		case "[ASSURED]":
+			status |= IPS_ASSURED
+			continue
+		}
+		if strings.HasPrefix(field, "[") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			if err = setConntrackState(&entry, proto, field); err != nil {
+				return ct.Con{}, err
+			}
+			continue
+		}
+
+		if key == "src" {
+			number := proto
+			tuples = append(tuples, &ct.IPTuple{Proto: &ct.ProtoTuple{Number: &number}})
+			counters = append(counters, nil)
+		}
+		if len(tuples) == 1 && key != "packets" && key != "bytes" {
+			id.Write([]byte(" " + field))
+		}
+
+		switch key {
+		case "src", "dst":
+			if len(tuples) == 0 {
+				continue
+			}
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return ct.Con{}, errors.Errorf("invalid address %q", field)
+			}
+			if key == "src" {
+				tuples[len(tuples)-1].Src = &ip
+			} else {
+				tuples[len(tuples)-1].Dst = &ip
+			}
+		case "sport", "dport", "id":
+			if len(tuples) == 0 {
+				continue
+			}
+			n, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return ct.Con{}, errors.Wrapf(err, "invalid %s", key)
+			}
+			v := uint16(n)
+			switch key {
+			case "sport":
+				tuples[len(tuples)-1].Proto.SrcPort = &v
+			case "dport":
+				tuples[len(tuples)-1].Proto.DstPort = &v
+			default:
+				tuples[len(tuples)-1].Proto.IcmpID = &v
+			}
+		case "type", "code":
+			if len(tuples) == 0 {
+				continue
+			}
+			n, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return ct.Con{}, errors.Wrapf(err, "invalid %s", key)
+			}
+			v := uint8(n)
+			setICMP(tuples[len(tuples)-1].Proto, proto, key, v)
+		case "packets", "bytes":
+			if len(counters) == 0 {
+				continue
+			}
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return ct.Con{}, errors.Wrapf(err, "invalid %s", key)
+			}
+			counter := counters[len(counters)-1]
+			if counter == nil {
+				counter = &ct.Counter{}
+				counters[len(counters)-1] = counter
+			}
+			if key == "packets" {
+				counter.Packets = &n
+			} else {
+				counter.Bytes = &n
+			}
+		case "mark":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return ct.Con{}, errors.Wrap(err, "invalid mark")
+			}
+			mark := uint32(n)
+			entry.Mark = &mark
+		case "zone", "zone-orig":
+			n, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return ct.Con{}, errors.Wrap(err, "invalid zone")
+			}
+			zone := uint16(n)
+			entry.Zone = &zone
+			id.Write([]byte(" " + field))
+		case "labels":
+			entryLabels, err = parseProcConnLabels(value)
+			if err != nil {
+				return ct.Con{}, err
+			}
+		case "delta-time":
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return ct.Con{}, errors.Wrap(err, "invalid delta-time")
+			}
+			start := now.Add(-time.Duration(n) * time.Second)
+			entry.Timestamp = &ct.Timestamp{Start: &start}
+		}
+	}
+
+	if len(tuples) < 2 || tuples[0].Src == nil || tuples[0].Dst == nil {
+		return ct.Con{}, errors.Errorf("missing tuples: %q", line)
+	}
+
+	entry.Origin, entry.Reply = tuples[0], tuples[1]
+	entry.CounterOrigin, entry.CounterReply = counters[0], counters[1]
+	entryID := id.Sum32()
+	entry.ID = &entryID
+	if entryLabels != "" {
+		labels[entryID] = entryLabels
+	}
+	return entry, nil
+}
+
+func setConntrackState(entry *ct.Con, proto uint8, name string) error {
+	name = strings.ReplaceAll(name, "_", "-")
+	switch proto {
+	case IPPROTO_TCP:
+		state, ok := procTCPStates[name]
+		if !ok {
+			return errors.Wrapf(errUnknownState, "TCP %q", name)
+		}
+		entry.ProtoInfo = &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &state}}
+	case IPPROTO_SCTP:
+		state, ok := procSCTPStates[name]
+		if !ok {
+			return errors.Wrapf(errUnknownState, "SCTP %q", name)
+		}
+		entry.ProtoInfo = &ct.ProtoInfo{SCTP: &ct.SCTPInfo{State: &state}}
+	}
+	return nil
+}
+
+func setICMP(tuple *ct.ProtoTuple, proto uint8, key string, value uint8) {
+	switch {
+	case proto == IPPROTO_ICMPV6 && key == "type":
+		tuple.Icmpv6Type = &value
+	case proto == IPPROTO_ICMPV6:
+		tuple.Icmpv6Code = &value
+	case key == "type":
+		tuple.IcmpType = &value
+	default:
+		tuple.IcmpCode = &value
+	}
+}
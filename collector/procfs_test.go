@@ -0,0 +1,126 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var conntrackFile = `ipv4     2 tcp      6 431999 ESTABLISHED src=10.10.1.2 dst=192.168.50.4 sport=33404 dport=2375 packets=10 bytes=1000 src=192.168.50.4 dst=10.10.1.2 sport=2375 dport=33404 packets=8 bytes=2000 [ASSURED] mark=16 zone=3 labels=22000000000000000000000000000000 delta-time=120 use=1
+ipv4     2 tcp      6 118 SYN_SENT src=10.10.1.2 dst=192.168.50.5 sport=33405 dport=443 [UNREPLIED] src=192.168.50.5 dst=10.10.1.2 sport=443 dport=33405 mark=0 delta-time=30 use=1
+ipv4     2 tcp      6 10 SYN_RECV src=10.10.1.2 dst=192.168.50.5 sport=33406 dport=443 src=192.168.50.5 dst=10.10.1.2 sport=443 dport=33406 mark=0 use=1
+ipv4     2 udp      17 28 src=10.10.1.2 dst=10.96.0.10 sport=41234 dport=53 [UNREPLIED] src=10.10.1.9 dst=10.10.1.2 sport=5353 dport=41234 mark=0 use=1
+ipv4     2 icmp     1 29 src=10.10.1.2 dst=192.168.50.4 type=8 code=0 id=42 src=192.168.50.4 dst=10.10.1.2 type=0 code=0 id=42 mark=0 use=1
+ipv6     10 icmpv6   58 29 src=2001:db8::1 dst=2001:db8::2 type=128 code=0 id=7 src=2001:db8::2 dst=2001:db8::1 type=129 code=0 id=7 mark=0 use=1
+ipv4     2 sctp     132 210 COOKIE_WAIT src=10.10.1.2 dst=192.168.50.6 sport=5000 dport=3868 [UNREPLIED] src=192.168.50.6 dst=10.10.1.2 sport=3868 dport=5000 mark=0 use=1
+ipv4     2 gre      47 179 timeout=180 stream_timeout=180 src=10.10.1.2 dst=192.168.50.7 srckey=0x0 dstkey=0x0 src=192.168.50.7 dst=10.10.1.2 srckey=0x0 dstkey=0x0 [ASSURED] mark=0 use=1
+ipv6     10 tcp      6 300 ESTABLISHED src=2001:db8::1 dst=2001:db8::2 sport=8080 dport=8081 src=2001:db8::2 dst=2001:db8::1 sport=8081 dport=8080 [ASSURED] mark=0 zone-orig=1 zone-reply=1 use=1
+`
+
+func TestParseConntrackFile(t *testing.T) {
+	now := time.Now().UTC()
+	entries, labels, err := parseConntrackFile(strings.NewReader(conntrackFile), now)
+	require.NoError(t, err)
+	require.Len(t, entries, 9)
+
+	entry := entries[0]
+	assert.Equal(t, "10.10.1.2", entry.Origin.Src.String())
+	assert.Equal(t, "192.168.50.4", entry.Origin.Dst.String())
+	assert.Equal(t, uint16(33404), *entry.Origin.Proto.SrcPort)
+	assert.Equal(t, uint16(2375), *entry.Origin.Proto.DstPort)
+	assert.Equal(t, uint16(2375), *entry.Reply.Proto.SrcPort)
+	assert.Equal(t, TCP_CONNTRACK_ESTABLISHED, *entry.ProtoInfo.TCP.State)
+	assert.Equal(t, uint64(10), *entry.CounterOrigin.Packets)
+	assert.Equal(t, uint64(1000), *entry.CounterOrigin.Bytes)
+	assert.Equal(t, uint64(8), *entry.CounterReply.Packets)
+	assert.Equal(t, uint64(2000), *entry.CounterReply.Bytes)
+	assert.Equal(t, IPS_SEEN_REPLY|IPS_ASSURED, *entry.Status)
+	assert.Equal(t, uint32(16), *entry.Mark)
+	assert.Equal(t, uint16(3), *entry.Zone)
+	assert.Equal(t, connLabels{*entry.ID: "1,5"}, labels)
+	assert.Equal(t, now.Add(-2*time.Minute), *entry.Timestamp.Start)
+
+	assert.Equal(t, TCP_CONNTRACK_SYN_SENT, *entries[1].ProtoInfo.TCP.State)
+	assert.Equal(t, uint32(0), *entries[1].Status)
+	assert.Nil(t, entries[1].CounterOrigin)
+	assert.Equal(t, SCTP_CONNTRACK_COOKIE_WAIT, *entries[6].ProtoInfo.SCTP.State)
+	assert.Equal(t, uint8(128), *entries[5].Origin.Proto.Icmpv6Type)
+	assert.Equal(t, uint16(1), *entries[8].Zone)
+
+	again, _, err := parseConntrackFile(strings.NewReader(strings.ReplaceAll(conntrackFile, "packets=10 bytes=1000", "packets=11 bytes=1100")), now)
+	require.NoError(t, err)
+	assert.Equal(t, *entries[0].ID, *again[0].ID)
+	assert.NotEqual(t, *entries[0].ID, *entries[1].ID)
+}
+
+func TestParseConntrackFileInvalid(t *testing.T) {
+	for _, line := range []string{
+		"ipv4 2 tcp",
+		"ipv4 2 tcp 6 10 ESTABLISHED src=10.10.1.2 dst=192.168.50.4 sport=1 dport=2",
+		"ipv4 2 tcp 6 10 ESTABLISHED src=invalid dst=192.168.50.4 sport=1 dport=2 src=192.168.50.4 dst=10.10.1.2 sport=2 dport=1",
+		"ipv4 2 tcp 6 10 ESTABLISHED src=10.10.1.2 dst=192.168.50.4 sport=70000 dport=2 src=192.168.50.4 dst=10.10.1.2 sport=2 dport=1",
+		"ipv4 2 tcp 6 10 ESTABLISHED src=10.10.1.2 dst=192.168.50.4 sport=1 dport=2 src=192.168.50.4 dst=10.10.1.2 sport=2 dport=1 labels=2x",
+	} {
+		_, _, err := parseConntrackFile(strings.NewReader(line), time.Now())
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseConntrackFileUnknownState(t *testing.T) {
+	file := `ipv4 2 tcp 6 10 UNKNOWN src=10.10.1.2 dst=192.168.50.4 sport=1 dport=2 src=192.168.50.4 dst=10.10.1.2 sport=2 dport=1
+ipv4 2 sctp 132 10 NONE src=10.10.1.2 dst=192.168.50.6 sport=5000 dport=3868 src=192.168.50.6 dst=10.10.1.2 sport=3868 dport=5000
+ipv4 2 tcp 6 10 ESTABLISHED src=10.10.1.2 dst=192.168.50.4 sport=3 dport=2 src=192.168.50.4 dst=10.10.1.2 sport=2 dport=3
+`
+	entries, _, err := parseConntrackFile(strings.NewReader(file), time.Now())
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, SCTP_CONNTRACK_NONE, *entries[0].ProtoInfo.SCTP.State)
+	assert.Equal(t, TCP_CONNTRACK_ESTABLISHED, *entries[1].ProtoInfo.TCP.State)
+}
+
+func TestFileConntrack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nf_conntrack")
+	err := os.WriteFile(path, []byte(conntrackFile), 0644)
+	require.NoError(t, err)
+
+	conntrack, err := NewFileConntrack(path, "")
+	require.NoError(t, err)
+	conns, err := conntrack()
+	require.NoError(t, err)
+	// SYN-RECV is not exported by default
+	require.Len(t, conns, 8)
+
+	conn := *conns[0]
+	assert.WithinDuration(t, time.Now().Add(-2*time.Minute), conn.Start, 5*time.Second)
+	conn.ID, conn.Start = 0, time.Time{}
+	assert.Equal(t, Conn{OriginIP: "10.10.1.2", DestIP: "192.168.50.4", OriginPort: 33404, DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "TCP", OriginBytes: 1000, ReplyBytes: 2000, OriginPackets: 10, ReplyPackets: 8, ReplyOriginIP: "192.168.50.4", ReplyDestIP: "10.10.1.2", ReplyOriginPort: 2375, ReplyDestPort: 33404, Zone: 3, Mark: 16, Labels: "1,5", Status: IPS_SEEN_REPLY | IPS_ASSURED}, conn)
+	assert.Equal(t, "SYN-SENT", conns[1].State)
+	assert.Equal(t, "10.10.1.9", conns[2].ReplyOriginIP)
+	assert.Equal(t, "type=8 code=0", conns[3].ICMP())
+	assert.Equal(t, "ICMPv6", conns[4].Protocol)
+	assert.Equal(t, "COOKIE-WAIT", conns[5].State)
+	assert.Equal(t, "GRE", conns[6].Protocol)
+	assert.Equal(t, "ipv6", conns[7].Family)
+
+	conntrack, err = NewFileConntrack(path, "udp,sctp")
+	require.NoError(t, err)
+	conns, err = conntrack()
+	require.NoError(t, err)
+	require.Len(t, conns, 2)
+	assert.Equal(t, "UDP", conns[0].Protocol)
+	assert.Equal(t, "SCTP", conns[1].Protocol)
+
+	conntrack, err = NewFileConntrack(filepath.Join(t.TempDir(), "missing"), "")
+	require.NoError(t, err)
+	_, err = conntrack()
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var snapshotAgeDesc = prometheus.NewDesc("conntrack_snapshot_age_seconds", "Age of the snapshot of connections served by the scrape", nil, nil)
+
+// snapshot holds the metrics built by a poll, it is never changed after
+// being built so scrapes can share it.
+type snapshot struct {
+	metrics []prometheus.Metric
+	time    time.Time
+}
+
+func (c *ConntrackCollector) poll() {
+	for {
+		c.performPoll()
+		time.Sleep(c.opts.PollInterval)
+	}
+}
+
+// performPoll builds a new snapshot, the previous one is kept when the poll
+// fails, the growing age of the snapshot tells how stale it is.
+func (c *ConntrackCollector) performPoll() {
+	counts, workloadMap, err := c.update()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		metrics := []prometheus.Metric{}
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		done <- metrics
+	}()
+	c.sendMetrics(counts, workloadMap, ch)
+	close(ch)
+
+	s := &snapshot{metrics: <-done, time: time.Now().UTC()}
+	c.snapshotMutex.Lock()
+	c.snapshot = s
+	c.snapshotMutex.Unlock()
+}
+
+func (c *ConntrackCollector) latestSnapshot() *snapshot {
+	c.snapshotMutex.Lock()
+	defer c.snapshotMutex.Unlock()
+	return c.snapshot
+}
+
+func (c *ConntrackCollector) collectSnapshot(ch chan<- prometheus.Metric) {
+	ch <- c.fetchWorkloads
+	ch <- c.fetchWorkloadFailures
+
+	s := c.latestSnapshot()
+	if s == nil {
+		return
+	}
+	for _, metric := range s.metrics {
+		ch <- metric
+	}
+	ch <- prometheus.MustNewConstMetric(snapshotAgeDesc, prometheus.GaugeValue, time.Since(s.time).Seconds())
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tsuru/prometheus-conntrack/workload"
+	workloadTesting "github.com/tsuru/prometheus-conntrack/workload/testing"
+)
+
+func TestCollectorSnapshot(t *testing.T) {
+	conntrack := &fakeConntrack{
+		conns: [][]*Conn{
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", OriginBytes: 100, ReplyBytes: 1000},
+			},
+			{
+				{ID: 1, OriginIP: "10.10.1.2", OriginPort: 33404, DestIP: "192.168.50.4", DestPort: 2375, Family: "ipv4", State: "ESTABLISHED", Protocol: "tcp", OriginBytes: 150, ReplyBytes: 1500},
+			},
+		},
+	}
+
+	classifier, err := NewCIDRClassifier(map[string]string{})
+	require.NoError(t, err)
+
+	collector, err := New(
+		workloadTesting.New("containerd", "container", []*workload.Workload{
+			{Name: "my-container1", IP: "10.10.1.2"},
+		}),
+		conntrack.conntrack,
+		[]string{},
+		&fakeDNSCache{},
+		classifier,
+		Opts{PollInterval: time.Hour},
+	)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return collector.latestSnapshot() != nil
+	}, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		lines := scrape(t, collector)
+		assert.Contains(t, lines, `conntrack_workload_connections{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",direction="outgoing",ip_family="ipv4",protocol="tcp",state="ESTABLISHED",status="unreplied",translated_destination="192.168.50.4:2375"} 1`)
+		assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 100`)
+		assert.Contains(t, lines, `conntrack_workload_fetch_total 1`)
+		assert.Regexp(t, `conntrack_snapshot_age_seconds \d`, strings.Join(lines, "\n"))
+	}
+	assert.Equal(t, 1, conntrack.calls)
+
+	collector.performPoll()
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_workload_origin_bytes_total{container="my-container1",destination="192.168.50.4:2375",destination_name="alice-service",destination_zone="",ip_family="ipv4",translated_destination="192.168.50.4:2375"} 150`)
+	assert.Equal(t, 2, conntrack.calls)
+}
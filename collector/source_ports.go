@@ -0,0 +1,186 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	sysctl "github.com/lorenzosaino/go-sysctl"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tsuru/prometheus-conntrack/workload"
+)
+
+var sourcePortsLabels = []string{"destination", "destination_name", "destination_zone", "ip_family", "protocol"}
+
+type sourcePortKey struct {
+	workload    string
+	sourceIP    string
+	destination destination
+	family      string
+	protocol    string
+}
+
+type sourcePortsValueKey struct {
+	workload    string
+	destination destination
+	family      string
+	protocol    string
+}
+
+// sourcePorts counts the distinct source ports in use by outgoing connections
+// on every scrape, per source IP and destination after NAT, as seen on the
+// reply tuple. A source IP runs out of ports to a destination when it uses the
+// whole ip_local_port_range, which is read once.
+type sourcePorts struct {
+	sync.Mutex
+	sysctl func(name string) (string, error)
+
+	ports     map[sourcePortKey]map[uint16]struct{}
+	rangeSize int
+	rangeRead bool
+}
+
+func newSourcePorts() *sourcePorts {
+	return &sourcePorts{
+		sysctl: sysctl.Get,
+		ports:  map[sourcePortKey]map[uint16]struct{}{},
+	}
+}
+
+// begin drops the ports of the previous scrape, ip_local_port_range is read
+// on the first one, the utilization is not exported when it fails
+func (s *sourcePorts) begin() {
+	s.ports = map[sourcePortKey]map[uint16]struct{}{}
+	if s.rangeRead {
+		return
+	}
+
+	rangeSize, err := s.localPortRangeSize()
+	if err != nil {
+		log.Print(err)
+	}
+	s.rangeSize = rangeSize
+	s.rangeRead = true
+}
+
+func (s *sourcePorts) localPortRangeSize() (int, error) {
+	value, err := s.sysctl("net.ipv4.ip_local_port_range")
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not read ip_local_port_range")
+	}
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return 0, errors.Errorf("Could not parse ip_local_port_range %q", value)
+	}
+	low, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not parse ip_local_port_range")
+	}
+	high, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not parse ip_local_port_range")
+	}
+	if high < low {
+		return 0, errors.Errorf("Could not parse ip_local_port_range %q", value)
+	}
+	return high - low + 1, nil
+}
+
+// track counts the source port of conn to the translated destination, the
+// source is the reply tuple destination, the address after SNAT.
+func (s *sourcePorts) track(workload string, conn *Conn, translated destination, direction ConnDirection) {
+	if direction != OutgoingConnection || conn.Closed || translated.port == 0 || translated.ip == overflowDestination {
+		return
+	}
+
+	sourceIP, sourcePort := conn.OriginIP, conn.OriginPort
+	if conn.ReplyDestIP != "" {
+		sourceIP, sourcePort = conn.ReplyDestIP, conn.ReplyDestPort
+	}
+
+	key := sourcePortKey{workload: workload, sourceIP: sourceIP, destination: translated, family: conn.Family, protocol: conn.Protocol}
+	ports, ok := s.ports[key]
+	if !ok {
+		ports = map[uint16]struct{}{}
+		s.ports[key] = ports
+	}
+	ports[sourcePort] = struct{}{}
+}
+
+// values returns the number of source ports of the busiest source IP of each
+// workload and destination.
+func (s *sourcePorts) values() map[sourcePortsValueKey]int {
+	values := map[sourcePortsValueKey]int{}
+	for key, ports := range s.ports {
+		valueKey := sourcePortsValueKey{workload: key.workload, destination: key.destination, family: key.family, protocol: key.protocol}
+		if len(ports) > values[valueKey] {
+			values[valueKey] = len(ports)
+		}
+	}
+	return values
+}
+
+func (c *ConntrackCollector) workloadSourcePortsDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, sourcePortsLabels...)
+
+	return prometheus.NewDesc("conntrack_workload_source_ports", "Number of source ports in use by workload connections to a destination", labels, nil)
+}
+
+func (c *ConntrackCollector) workloadSourcePortsUtilizationDesc() *prometheus.Desc {
+	labels := []string{}
+	labels = append(labels, c.sanitizedWorkloadLabels...)
+	labels = append(labels, sourcePortsLabels...)
+
+	return prometheus.NewDesc("conntrack_workload_source_ports_utilization", "Ratio of ip_local_port_range in use by workload connections to a destination", labels, nil)
+}
+
+var (
+	nodeSourcePortsDesc            = prometheus.NewDesc("conntrack_node_source_ports", "Number of source ports in use by node connections to a destination", sourcePortsLabels, nil)
+	nodeSourcePortsUtilizationDesc = prometheus.NewDesc("conntrack_node_source_ports_utilization", "Ratio of ip_local_port_range in use by node connections to a destination", sourcePortsLabels, nil)
+)
+
+func (c *ConntrackCollector) describeSourcePorts(ch chan<- *prometheus.Desc) {
+	ch <- c.workloadSourcePortsDesc()
+	ch <- c.workloadSourcePortsUtilizationDesc()
+	ch <- nodeSourcePortsDesc
+	ch <- nodeSourcePortsUtilizationDesc
+}
+
+func (c *ConntrackCollector) sendSourcePortsMetrics(workloads map[string]*workload.Workload, ch chan<- prometheus.Metric) {
+	c.sourcePorts.Lock()
+	defer c.sourcePorts.Unlock()
+
+	workloadSourcePortsDesc := c.workloadSourcePortsDesc()
+	workloadSourcePortsUtilizationDesc := c.workloadSourcePortsUtilizationDesc()
+	for key, ports := range c.sourcePorts.values() {
+		name, zone := c.destinationNames(key.destination.ip)
+		values := []string{key.destination.String(), name, zone, key.family, key.protocol}
+		sourcePortsDesc, utilizationDesc := nodeSourcePortsDesc, nodeSourcePortsUtilizationDesc
+
+		if key.workload != "" {
+			workload := workloads[key.workload]
+			if workload == nil {
+				continue
+			}
+			workloadValues := []string{workload.Name}
+			for _, k := range c.workloadLabels {
+				workloadValues = append(workloadValues, workload.Labels[k])
+			}
+			values = append(workloadValues, values...)
+			sourcePortsDesc, utilizationDesc = workloadSourcePortsDesc, workloadSourcePortsUtilizationDesc
+		}
+
+		ch <- prometheus.MustNewConstMetric(sourcePortsDesc, prometheus.GaugeValue, float64(ports), values...)
+		if c.sourcePorts.rangeSize > 0 {
+			ch <- prometheus.MustNewConstMetric(utilizationDesc, prometheus.GaugeValue, float64(ports)/float64(c.sourcePorts.rangeSize), values...)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalPortRangeSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		err      error
+		expected int
+		valid    bool
+	}{
+		{value: "32768\t60999", expected: 28232, valid: true},
+		{value: "1024 65535\n", expected: 64512, valid: true},
+		{value: "1024", valid: false},
+		{value: "60999 32768", valid: false},
+		{value: "a b", valid: false},
+		{err: errors.New("not found"), valid: false},
+	}
+
+	for _, tt := range tests {
+		s := &sourcePorts{sysctl: func(name string) (string, error) {
+			assert.Equal(t, "net.ipv4.ip_local_port_range", name)
+			return tt.value, tt.err
+		}}
+		size, err := s.localPortRangeSize()
+		if !tt.valid {
+			assert.Error(t, err, tt.value)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, size)
+	}
+}
+
+func TestSourcePortsValues(t *testing.T) {
+	s := newSourcePorts()
+	d := destination{ip: "192.168.50.4", port: 443}
+	s.track("w1", &Conn{OriginIP: "10.10.1.2", OriginPort: 40000, Family: "ipv4", Protocol: "TCP"}, d, OutgoingConnection)
+	s.track("w1", &Conn{OriginIP: "10.10.1.2", OriginPort: 40001, Family: "ipv4", Protocol: "TCP"}, d, OutgoingConnection)
+	s.track("w1", &Conn{OriginIP: "10.10.1.2", OriginPort: 40001, Family: "ipv4", Protocol: "TCP"}, d, OutgoingConnection)
+	s.track("w1", &Conn{OriginIP: "10.10.1.3", OriginPort: 40000, Family: "ipv4", Protocol: "TCP"}, d, OutgoingConnection)
+	// masqueraded to 10.10.1.2
+	s.track("w1", &Conn{OriginIP: "10.10.1.4", OriginPort: 40000, ReplyOriginIP: "192.168.50.4", ReplyOriginPort: 443, ReplyDestIP: "10.10.1.2", ReplyDestPort: 40005, Family: "ipv4", Protocol: "TCP"}, d, OutgoingConnection)
+	s.track("w1", &Conn{OriginIP: "10.10.1.2", OriginPort: 40002, Family: "ipv4", Protocol: "TCP", Closed: true}, d, OutgoingConnection)
+	s.track("w1", &Conn{OriginIP: "192.168.50.4", OriginPort: 40003, Family: "ipv4", Protocol: "TCP"}, destination{port: 8080}, IncomingConnection)
+	ping := &Conn{OriginIP: "10.10.1.2", DestIP: "192.168.50.4", Family: "ipv4", Protocol: "ICMP", IcmpType: 8}
+	s.track("w1", ping, destination{ip: ping.DestIP, icmp: ping.ICMP()}, OutgoingConnection)
+
+	assert.Equal(t, map[sourcePortsValueKey]int{
+		{workload: "w1", destination: d, family: "ipv4", protocol: "TCP"}: 3,
+	}, s.values())
+}
+
+func TestSourcePortsRangeCached(t *testing.T) {
+	reads := 0
+	s := newSourcePorts()
+	s.sysctl = func(name string) (string, error) {
+		reads++
+		return "60000\t60999", nil
+	}
+
+	s.begin()
+	s.begin()
+	assert.Equal(t, 1000, s.rangeSize)
+	assert.Equal(t, 1, reads)
+
+	reads = 0
+	s = newSourcePorts()
+	s.sysctl = func(name string) (string, error) {
+		reads++
+		return "", errors.New("not found")
+	}
+
+	s.begin()
+	s.begin()
+	assert.Equal(t, 0, s.rangeSize)
+	assert.Equal(t, 1, reads)
+}
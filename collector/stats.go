@@ -0,0 +1,240 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	sysctl "github.com/lorenzosaino/go-sysctl"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var tableSysctls = []struct {
+	name string
+	desc *prometheus.Desc
+}{
+	{"net.netfilter.nf_conntrack_count", prometheus.NewDesc("conntrack_nf_conntrack_count", "Number of entries in the conntrack table", nil, nil)},
+	{"net.netfilter.nf_conntrack_max", prometheus.NewDesc("conntrack_nf_conntrack_max", "Maximum number of entries in the conntrack table", nil, nil)},
+	{"net.netfilter.nf_conntrack_buckets", prometheus.NewDesc("conntrack_nf_conntrack_buckets", "Size of the conntrack hash table", nil, nil)},
+}
+
+var cpuStats = []struct {
+	desc  *prometheus.Desc
+	value func(stat *ct.CPUStat) *uint32
+}{
+	{cpuStatDesc("found", "Number of successful searches"), func(s *ct.CPUStat) *uint32 { return s.Found }},
+	{cpuStatDesc("invalid", "Number of packets that could not be tracked"), func(s *ct.CPUStat) *uint32 { return s.Invalid }},
+	{cpuStatDesc("insert", "Number of inserted entries"), func(s *ct.CPUStat) *uint32 { return s.Insert }},
+	{cpuStatDesc("insert_failed", "Number of entries that could not be inserted, ie: a clash with an existing entry"), func(s *ct.CPUStat) *uint32 { return s.InsertFailed }},
+	{cpuStatDesc("drop", "Number of packets dropped because the table was full"), func(s *ct.CPUStat) *uint32 { return s.Drop }},
+	{cpuStatDesc("early_drop", "Number of entries dropped to make room for new ones"), func(s *ct.CPUStat) *uint32 { return s.EarlyDrop }},
+	{cpuStatDesc("error", "Number of packets dropped by ICMP errors"), func(s *ct.CPUStat) *uint32 { return s.Error }},
+	{cpuStatDesc("search_restart", "Number of table searches restarted due to a hash resize"), func(s *ct.CPUStat) *uint32 { return s.SearchRestart }},
+}
+
+func cpuStatDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc("conntrack_cpu_"+name+"_total", help+", per CPU", []string{"cpu"}, nil)
+}
+
+// StatsCollector exports the health of the conntrack table, its usage and
+// the per-CPU statistics, to detect table exhaustion.
+type StatsCollector struct {
+	sysctl      func(name string) (string, error)
+	dumpCPUStat func() ([]ct.CPUStat, error)
+}
+
+// NewStatsCollector returns a StatsCollector reading the per-CPU statistics
+// from cpuStats, which can be shared with the DNS health of ConntrackCollector.
+func NewStatsCollector(cpuStats *CPUStats) *StatsCollector {
+	return &StatsCollector{
+		sysctl:      sysctl.Get,
+		dumpCPUStat: cpuStats.dump,
+	}
+}
+
+// DefaultCPUStatFile is the procfs file with the per-CPU conntrack statistics
+// of the network namespace of the exporter.
+const DefaultCPUStatFile = "/proc/net/stat/nf_conntrack"
+
+// cpuStatsTTL is how long a read of the statistics is reused, the collectors
+// sharing CPUStats are scraped at the same time.
+var cpuStatsTTL = time.Second
+
+// CPUStats reads the per-CPU conntrack statistics over netlink, falling back
+// to DefaultCPUStatFile when netlink is not available (ie: without
+// CAP_NET_ADMIN).
+type CPUStats struct {
+	sync.Mutex
+	path        string
+	dumpNetlink func() ([]ct.CPUStat, error)
+	procfs      bool
+	last        []ct.CPUStat
+	lastRead    time.Time
+}
+
+func NewCPUStats() *CPUStats {
+	return &CPUStats{
+		path:        DefaultCPUStatFile,
+		dumpNetlink: dumpCPUStat,
+	}
+}
+
+func (s *CPUStats) dump() ([]ct.CPUStat, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if s.last != nil && now.Sub(s.lastRead) < cpuStatsTTL {
+		return s.last, nil
+	}
+
+	stats, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.last, s.lastRead = stats, now
+	return stats, nil
+}
+
+func (s *CPUStats) read() ([]ct.CPUStat, error) {
+	if !s.procfs {
+		stats, err := s.dumpNetlink()
+		if err == nil {
+			return stats, nil
+		}
+		log.Printf("Could not dump conntrack stats over netlink, reading %s instead, err: %s", s.path, err.Error())
+		s.procfs = true
+	}
+	return readCPUStatFile(s.path)
+}
+
+func dumpCPUStat() ([]ct.CPUStat, error) {
+	nfct, err := ct.Open(&ct.Config{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create nfct")
+	}
+	defer nfct.Close()
+
+	stats, err := nfct.DumpCPUStats(ct.Conntrack)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not dump conntrack stats")
+	}
+	return stats, nil
+}
+
+var cpuStatColumns = map[string]func(stat *ct.CPUStat, value *uint32){
+	"found":          func(s *ct.CPUStat, v *uint32) { s.Found = v },
+	"invalid":        func(s *ct.CPUStat, v *uint32) { s.Invalid = v },
+	"ignore":         func(s *ct.CPUStat, v *uint32) { s.Ignore = v },
+	"insert":         func(s *ct.CPUStat, v *uint32) { s.Insert = v },
+	"insert_failed":  func(s *ct.CPUStat, v *uint32) { s.InsertFailed = v },
+	"drop":           func(s *ct.CPUStat, v *uint32) { s.Drop = v },
+	"early_drop":     func(s *ct.CPUStat, v *uint32) { s.EarlyDrop = v },
+	"icmp_error":     func(s *ct.CPUStat, v *uint32) { s.Error = v },
+	"search_restart": func(s *ct.CPUStat, v *uint32) { s.SearchRestart = v },
+	"expect_new":     func(s *ct.CPUStat, v *uint32) { s.ExpNew = v },
+	"expect_create":  func(s *ct.CPUStat, v *uint32) { s.ExpCreate = v },
+	"expect_delete":  func(s *ct.CPUStat, v *uint32) { s.ExpDelete = v },
+}
+
+// readCPUStatFile parses the statistics of /proc/net/stat/nf_conntrack, a
+// header naming the columns followed by a line of hexadecimal values per CPU.
+// The columns vary between kernels, the unknown ones are ignored.
+func readCPUStatFile(path string) ([]ct.CPUStat, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open conntrack stats file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		if err = scanner.Err(); err != nil {
+			return nil, errors.Wrap(err, "Could not read conntrack stats file")
+		}
+		return nil, errors.New("Could not read conntrack stats file: empty file")
+	}
+	columns := strings.Fields(scanner.Text())
+
+	stats := []ct.CPUStat{}
+	for scanner.Scan() {
+		values := strings.Fields(scanner.Text())
+		if len(values) == 0 {
+			continue
+		}
+		if len(values) != len(columns) {
+			return nil, errors.Errorf("Could not parse conntrack stats file, expected %d columns: %q", len(columns), scanner.Text())
+		}
+
+		stat := ct.CPUStat{ID: uint32(len(stats))}
+		for i, column := range columns {
+			set, ok := cpuStatColumns[column]
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseUint(values[i], 16, 32)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Could not parse conntrack stats file column %s", column)
+			}
+			value := uint32(n)
+			set(&stat, &value)
+		}
+		stats = append(stats, stat)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Could not read conntrack stats file")
+	}
+
+	return stats, nil
+}
+
+func (s *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, t := range tableSysctls {
+		ch <- t.desc
+	}
+	for _, stat := range cpuStats {
+		ch <- stat.desc
+	}
+}
+
+func (s *StatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range tableSysctls {
+		val, err := s.sysctl(t.name)
+		if err != nil {
+			log.Printf("Could not read %s, err: %s", t.name, err.Error())
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil {
+			log.Printf("Could not parse %s, err: %s", t.name, err.Error())
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(t.desc, prometheus.GaugeValue, value)
+	}
+
+	stats, err := s.dumpCPUStat()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for i := range stats {
+		cpu := strconv.Itoa(int(stats[i].ID))
+		for _, stat := range cpuStats {
+			value := stat.value(&stats[i])
+			if value == nil {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(stat.desc, prometheus.CounterValue, float64(*value), cpu)
+		}
+	}
+}
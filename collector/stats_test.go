@@ -0,0 +1,137 @@
+// Copyright 2016 conntrack-prometheus authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package collector
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func uint32Ptr(v uint32) *uint32 {
+	return &v
+}
+
+func TestStatsCollector(t *testing.T) {
+	collector := &StatsCollector{
+		sysctl: func(name string) (string, error) {
+			return map[string]string{
+				"net.netfilter.nf_conntrack_count":   "1024\n",
+				"net.netfilter.nf_conntrack_max":     "262144",
+				"net.netfilter.nf_conntrack_buckets": "65536",
+			}[name], nil
+		},
+		dumpCPUStat: func() ([]ct.CPUStat, error) {
+			return []ct.CPUStat{
+				{ID: 0, Found: uint32Ptr(10), Invalid: uint32Ptr(1), Insert: uint32Ptr(0), InsertFailed: uint32Ptr(3), Drop: uint32Ptr(4), EarlyDrop: uint32Ptr(5), Error: uint32Ptr(6), SearchRestart: uint32Ptr(7)},
+				{ID: 1, InsertFailed: uint32Ptr(8)},
+			}, nil
+		},
+	}
+
+	lines := scrape(t, collector)
+	assert.Contains(t, lines, `conntrack_nf_conntrack_count 1024`)
+	assert.Contains(t, lines, `conntrack_nf_conntrack_max 262144`)
+	assert.Contains(t, lines, `conntrack_nf_conntrack_buckets 65536`)
+	assert.Contains(t, lines, `conntrack_cpu_found_total{cpu="0"} 10`)
+	assert.Contains(t, lines, `conntrack_cpu_invalid_total{cpu="0"} 1`)
+	assert.Contains(t, lines, `conntrack_cpu_insert_total{cpu="0"} 0`)
+	assert.Contains(t, lines, `conntrack_cpu_insert_failed_total{cpu="0"} 3`)
+	assert.Contains(t, lines, `conntrack_cpu_insert_failed_total{cpu="1"} 8`)
+	assert.Contains(t, lines, `conntrack_cpu_drop_total{cpu="0"} 4`)
+	assert.Contains(t, lines, `conntrack_cpu_early_drop_total{cpu="0"} 5`)
+	assert.Contains(t, lines, `conntrack_cpu_error_total{cpu="0"} 6`)
+	assert.Contains(t, lines, `conntrack_cpu_search_restart_total{cpu="0"} 7`)
+	assert.NotContains(t, lines, `conntrack_cpu_found_total{cpu="1"} 0`)
+}
+
+func TestStatsCollectorFailures(t *testing.T) {
+	collector := &StatsCollector{
+		sysctl: func(name string) (string, error) {
+			if name == "net.netfilter.nf_conntrack_max" {
+				return "invalid", nil
+			}
+			return "", errors.New("not found")
+		},
+		dumpCPUStat: func() ([]ct.CPUStat, error) {
+			return nil, errors.New("permission denied")
+		},
+	}
+
+	for _, line := range scrape(t, collector) {
+		assert.NotRegexp(t, `^conntrack_`, line)
+	}
+}
+
+const cpuStatFile = `entries  clashres found new invalid ignore delete chainlength insert insert_failed drop early_drop icmp_error  expect_new expect_create expect_delete search_restart
+00000010  00000000 0000000a 00000000 00000001 00000000 00000000 00000000 00000000 00000003 00000004 00000005 00000006  00000000 00000000 00000000 00000007
+00000010  00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000 0000001f 00000000 00000000 00000000  00000000 00000000 00000000 00000000
+`
+
+func TestReadCPUStatFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nf_conntrack")
+	require.NoError(t, os.WriteFile(path, []byte(cpuStatFile), 0644))
+
+	stats, err := readCPUStatFile(path)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, uint32(0), stats[0].ID)
+	assert.Equal(t, uint32(10), *stats[0].Found)
+	assert.Equal(t, uint32(1), *stats[0].Invalid)
+	assert.Equal(t, uint32(3), *stats[0].InsertFailed)
+	assert.Equal(t, uint32(6), *stats[0].Error)
+	assert.Equal(t, uint32(7), *stats[0].SearchRestart)
+	assert.Equal(t, uint32(1), stats[1].ID)
+	assert.Equal(t, uint32(31), *stats[1].InsertFailed)
+
+	require.NoError(t, os.WriteFile(path, []byte("found insert\n1 2 3\n"), 0644))
+	_, err = readCPUStatFile(path)
+	assert.Error(t, err)
+	_, err = readCPUStatFile(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestCPUStatsFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nf_conntrack")
+	require.NoError(t, os.WriteFile(path, []byte(cpuStatFile), 0644))
+
+	netlinkCalls := 0
+	s := &CPUStats{path: path, dumpNetlink: func() ([]ct.CPUStat, error) {
+		netlinkCalls++
+		return nil, errors.New("operation not permitted")
+	}}
+
+	for i := 0; i < 2; i++ {
+		stats, err := s.read()
+		require.NoError(t, err)
+		assert.Len(t, stats, 2)
+	}
+	assert.Equal(t, 1, netlinkCalls)
+}
+
+func TestCPUStatsShared(t *testing.T) {
+	calls := 0
+	s := &CPUStats{dumpNetlink: func() ([]ct.CPUStat, error) {
+		calls++
+		return []ct.CPUStat{{ID: 0, InsertFailed: uint32Ptr(uint32(calls))}}, nil
+	}}
+
+	first, err := s.dump()
+	require.NoError(t, err)
+	second, err := s.dump()
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, calls)
+
+	s.lastRead = s.lastRead.Add(-cpuStatsTTL)
+	third, err := s.dump()
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), *third[0].InsertFailed)
+}
@@ -1,25 +1,38 @@
 package collector
 
 import (
-	"fmt"
 	"sync"
 	"time"
 )
 
 type connTrafficKey struct {
-	Workload  string
-	IP        string
-	Port      uint16
-	Direction ConnDirection
+	Workload       string
+	IP             string
+	Port           uint16
+	ICMP           string
+	TranslatedIP   string
+	TranslatedPort uint16
+	Direction      ConnDirection
+	Family         string
+	Zone           uint16
+	Mark           uint32
+	Connlabels     string
+	Source         connSource
 }
 
 func (c connTrafficKey) DestinationString() string {
-	return fmt.Sprintf("%s:%d", c.IP, c.Port)
+	return formatDestination(c.IP, c.Port, c.ICMP)
+}
+
+func (c connTrafficKey) TranslatedDestinationString() string {
+	return formatDestination(c.TranslatedIP, c.TranslatedPort, c.ICMP)
 }
 
 type connTrafficValue struct {
 	OriginCounter uint64
 	ReplyCounter  uint64
+	OriginPackets uint64
+	ReplyPackets  uint64
 	LastUsed      time.Time
 }
 
@@ -45,7 +58,7 @@ func newTrafficCounter() *trafficCounter {
 	return tc
 }
 
-func (t *trafficCounter) Inc(key connTrafficKey, id uint32, originCounter uint64, replyCounter uint64, now time.Time) {
+func (t *trafficCounter) Inc(key connTrafficKey, id uint32, originCounter, replyCounter, originPackets, replyPackets uint64, now time.Time) {
 	// TODO: clean conn ID that was used before to avoid colision
 	v, ok := t.m[key]
 
@@ -58,28 +71,32 @@ func (t *trafficCounter) Inc(key connTrafficKey, id uint32, originCounter uint64
 	previousConnState, ok := t.previousConnState[id]
 
 	if ok {
-		var diffOriginCounter uint64
-		if originCounter > previousConnState.OriginCounter {
-			diffOriginCounter = originCounter - previousConnState.OriginCounter
-		}
-		if diffOriginCounter > 0 {
-			v.OriginCounter += diffOriginCounter
-		}
-
-		var diffReplyCounter uint64
-		if replyCounter > previousConnState.ReplyCounter {
-			diffReplyCounter = replyCounter - previousConnState.ReplyCounter
-		}
-
-		if diffReplyCounter > 0 {
-			v.ReplyCounter += diffReplyCounter
-		}
+		v.OriginCounter += counterDiff(originCounter, previousConnState.OriginCounter)
+		v.ReplyCounter += counterDiff(replyCounter, previousConnState.ReplyCounter)
+		v.OriginPackets += counterDiff(originPackets, previousConnState.OriginPackets)
+		v.ReplyPackets += counterDiff(replyPackets, previousConnState.ReplyPackets)
 	} else {
 		v.OriginCounter += originCounter
 		v.ReplyCounter += replyCounter
+		v.OriginPackets += originPackets
+		v.ReplyPackets += replyPackets
+	}
+
+	t.previousConnState[id] = &connTrafficValue{OriginCounter: originCounter, ReplyCounter: replyCounter, OriginPackets: originPackets, ReplyPackets: replyPackets, LastUsed: now}
+}
+
+// counterDiff returns how much a connection counter increased, counters
+// never decrease so a lower value is ignored
+func counterDiff(current, previous uint64) uint64 {
+	if current > previous {
+		return current - previous
 	}
+	return 0
+}
 
-	t.previousConnState[id] = &connTrafficValue{OriginCounter: originCounter, ReplyCounter: replyCounter, LastUsed: now}
+// Forget drops the last known counters of a closed connection
+func (t *trafficCounter) Forget(id uint32) {
+	delete(t.previousConnState, id)
 }
 
 func (t *trafficCounter) cleaner() {
@@ -15,7 +15,7 @@ import (
 func TestTrafficCounterOnce(t *testing.T) {
 	now := time.Now().UTC()
 	tc := newTrafficCounter()
-	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 10, 10, now)
+	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 10, 10, 1, 1, now)
 
 	items := tc.List()
 
@@ -31,9 +31,9 @@ func TestTrafficCounterTwice(t *testing.T) {
 	now := time.Now().UTC()
 
 	tc := newTrafficCounter()
-	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 10, 10, now)
-	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 11, 110, 110, now)
-	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 100, 100, now)
+	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 10, 10, 1, 1, now)
+	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 11, 110, 110, 1, 1, now)
+	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 100, 100, 1, 1, now)
 
 	items := tc.List()
 
@@ -43,14 +43,16 @@ func TestTrafficCounterTwice(t *testing.T) {
 	assert.Equal(t, items[0].Direction, OutgoingConnection)
 	assert.Equal(t, int(items[0].ReplyCounter), 210)
 	assert.Equal(t, int(items[0].OriginCounter), 210)
+	assert.Equal(t, int(items[0].ReplyPackets), 2)
+	assert.Equal(t, int(items[0].OriginPackets), 2)
 }
 
 func TestTrafficCounterNeverDecreasesCounter(t *testing.T) {
 	now := time.Now().UTC()
 
 	tc := newTrafficCounter()
-	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 10, 10, now)
-	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 9, 9, now)
+	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 10, 10, 1, 1, now)
+	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 9, 9, 1, 1, now)
 
 	items := tc.List()
 
@@ -66,8 +68,8 @@ func TestTrafficCounterClean(t *testing.T) {
 	now := time.Now().UTC().Add(time.Hour * -1)
 
 	tc := newTrafficCounter()
-	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 10, 10, now)
-	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 9, 9, now)
+	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 10, 10, 1, 1, now)
+	tc.Inc(connTrafficKey{IP: "10.1.1.1", Port: 8000, Direction: OutgoingConnection}, 10, 9, 9, 1, 1, now)
 
 	tc.doClean()
 
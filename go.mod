@@ -6,6 +6,7 @@ require (
 	github.com/florianl/go-conntrack v0.1.1-0.20200305095641-39d61234c658
 	github.com/fsouza/go-dockerclient v0.0.0-20161206004320-4611598e6e66
 	github.com/lorenzosaino/go-sysctl v0.1.0
+	github.com/mdlayher/netlink v1.1.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.6.0
@@ -28,7 +29,6 @@ require (
 	github.com/gorilla/mux v0.0.0-20160920230813-757bef944d0f // indirect
 	github.com/hashicorp/go-cleanhttp v0.0.0-20160407174126-ad28ea4487f0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
-	github.com/mdlayher/netlink v1.1.0 // indirect
 	github.com/opencontainers/runc v1.0.0-rc2.0.20161027022316-e7abf30cb820 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
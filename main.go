@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	_ "net/http/pprof"
 
@@ -21,15 +22,45 @@ import (
 	"github.com/tsuru/prometheus-conntrack/workload/kubelet"
 )
 
-const conntrackTimestampFlag = "net.netfilter.nf_conntrack_timestamp"
+const (
+	conntrackTimestampFlag  = "net.netfilter.nf_conntrack_timestamp"
+	conntrackAccountingFlag = "net.netfilter.nf_conntrack_acct"
+)
 
 func main() {
 	addr := flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
-	protocol := flag.String("protocol", "", "Protocol to track connections. Defaults to all.")
+	protocol := flag.String("protocol", "", "Comma separated protocols to track connections, ie (tcp,udp). Defaults to all.")
 	engineName := flag.String("engine", "docker", "Engine to track local workload addresses. Defaults to docker.")
 	workloadLabelsString := flag.String("workload-labels", "", "Labels to extract from workload. ie (tsuru.io/app-name,tsuru.io/process-name)")
 	cidrClassesString := flag.String("cidr-classes", "", "CIDRs to extract labels. ie (10.0.0.0/8=internal,0.0.0.0/0=internet)")
 
+	source := flag.String("source", "dump", "Source of conntrack entries: dump (dump the table on every scrape), events (keep a table updated by conntrack events) or file (parse the procfs text format from -conntrack-file).")
+	conntrackFile := flag.String("conntrack-file", collector.DefaultConntrackFile, "Path of the conntrack table in procfs text format, used with -source=file.")
+	eventsResyncInterval := flag.Duration("events-resync-interval", time.Minute, "Interval to reconcile the table built from events with a full dump, used with -source=events.")
+
+	netns := flag.Bool("netns", false, "Dump the conntrack table of each workload network namespace instead of attributing workloads from the node table, requires CAP_SYS_ADMIN and the host PID namespace.")
+	procPath := flag.String("proc-path", "/proc", "Mount point of the host procfs, used to reach the workloads network namespaces with -netns.")
+	zoneLabel := flag.Bool("zone-label", false, "Add the conntrack zone as a label of connections and traffic metrics.")
+	markLabel := flag.Bool("mark-label", false, "Add the conntrack mark as a label of connections and traffic metrics.")
+	connlabelsLabel := flag.Bool("connlabels-label", false, "Add the connlabel bits of connections (ie: 1,5) as a label of connections and traffic metrics, not available with -source events.")
+	destinationWorkloadLabel := flag.Bool("destination-workload-label", false, "Add the workload owning the destination, and its -workload-labels, as labels of connections and traffic metrics.")
+	incomingSourceLabel := flag.Bool("incoming-source-label", false, "Add the origin of incoming connections as source, source_name and source_zone labels of connections and traffic metrics.")
+	incomingSourceClasses := flag.Bool("incoming-source-classes", false, "Collapse the origin of incoming connections to its -cidr-classes, only source_zone is filled, implies -incoming-source-label.")
+	forwarded := flag.Bool("forwarded", false, "Report the connections that only pass through the node (ie: gateways and routers) on node metrics with direction=\"forwarded\", implies -incoming-source-label.")
+	markClassesFile := flag.String("mark-classes", "", "Path to a file mapping conntrack marks to class names, one per line ie (0x1=egress-proxy), implies -mark-label.")
+	connlabelFile := flag.String("connlabel-file", "", "Path to a connlabel.conf file naming the connlabel bits, one per line ie (1 egress-proxy), implies -connlabels-label.")
+	pollInterval := flag.Duration("poll-interval", 0, "Interval to poll the conntrack entries in background, scrapes serve the latest snapshot. Defaults to poll on every scrape.")
+	dnsWorkers := flag.Int("dns-workers", collector.DefaultDNSWorkers, "Number of concurrent reverse DNS lookups of destinations.")
+	dnsQueueSize := flag.Int("dns-queue-size", collector.DefaultDNSQueueSize, "Number of destinations waiting to be resolved, the ones beyond are retried on the next scrape.")
+	dnsTimeout := flag.Duration("dns-timeout", collector.DefaultDNSTimeout, "Timeout of each reverse DNS lookup of destinations.")
+	maxDestinationsPerWorkload := flag.Int("max-destinations-per-workload", 0, "Maximum number of destinations tracked per workload, the ones beyond are aggregated on destination=\"other\". Defaults to no limit.")
+	maxSeries := flag.Int("max-series", 0, "Maximum number of connection series (ie: conntrack_workload_connections) tracked across all workloads and the node, the ones beyond are aggregated on destination=\"other\". Defaults to no limit.")
+	trackSourcePorts := flag.Bool("track-source-ports", false, "Turn on the count of source ports in use per destination, compared with net.ipv4.ip_local_port_range to detect port exhaustion.")
+	dnsHealth := flag.Bool("dns-health", false, "Turn on the metrics of workload DNS flows (port 53), replied or not, by resolver.")
+	tcpStates := flag.String("tcp-states", "", "Comma separated TCP states to track, ie (ESTABLISHED,SYN-RECV,FIN-WAIT). Defaults to "+strings.Join(collector.DefaultTCPStates, ",")+".")
+
+	synSentToleration := flag.Duration("syn-sent-toleration", collector.DefaultSynSentToleration, "How long a connection stays on SYN-SENT before being exported as stuck, used with -track-syn-sent.")
+	trackConnectionAge := flag.Bool("track-connection-age", false, "Turn on the histograms of age and lifetime of workload connections, will enable automatically the net.netfilter.nf_conntrack_timestamp flag on kernel.")
 	trackSynSent := flag.Bool("track-syn-sent", false, "Turn on track of stuck connections with syn-sent, will enable automatically the net.netfilter.nf_conntrack_timestamp flag on kernel.")
 
 	dockerEndpoint := flag.String("docker-endpoint", "unix:///var/run/docker.sock", "Docker endpoint.")
@@ -42,14 +73,25 @@ func main() {
 
 	flag.Parse()
 
-	if *trackSynSent {
-		enableConntrackTimestamps()
+	if err := collector.SetTCPStates(*tcpStates); err != nil {
+		log.Fatal(err)
+	}
+	if err := collector.SetSynSentToleration(*synSentToleration); err != nil {
+		log.Fatal(err)
+	}
+
+	if *trackSynSent || *trackConnectionAge {
+		enableConntrackFlag(conntrackTimestampFlag)
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
 
 	var engine workload.Engine
 	var err error
+	kubeletProcPath := ""
+	if *netns {
+		kubeletProcPath = *procPath
+	}
 	if *engineName == "kubelet" {
 		log.Printf("Fetching workload from kubelet: %s...\n", *kubeletEndpoint)
 		engine, err = kubelet.NewEngine(kubelet.Opts{
@@ -58,6 +100,7 @@ func main() {
 			Cert:     *kubeletCert,
 			CA:       *kubeletCA,
 			Token:    *kubeletToken,
+			ProcPath: kubeletProcPath,
 
 			InsecureSkipVerify: *insecureSkipTLSVerify,
 		})
@@ -89,32 +132,100 @@ func main() {
 		log.Fatal(err)
 	}
 
-	conntrack := collector.NewConntrack(*protocol)
-	collector, err := collector.New(engine, conntrack, workloadLabels, nil, classifier)
+	var conntrack collector.Conntrack
+	switch *source {
+	case "dump":
+		conntrack, err = collector.NewConntrack(*protocol)
+	case "events":
+		// bytes of closed connections are only reported on DESTROY events with accounting enabled
+		enableConntrackFlag(conntrackAccountingFlag)
+		log.Printf("Tracking connections by conntrack events, resync interval: %s...\n", *eventsResyncInterval)
+		conntrack, err = collector.NewEventConntrack(*protocol, *eventsResyncInterval)
+	case "file":
+		log.Printf("Reading connections from %s...\n", *conntrackFile)
+		conntrack, err = collector.NewFileConntrack(*conntrackFile, *protocol)
+	default:
+		log.Fatalf("Invalid source: %s", *source)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := collector.Opts{
+		ZoneLabel:                  *zoneLabel,
+		MarkLabel:                  *markLabel,
+		ConnlabelsLabel:            *connlabelsLabel,
+		DestinationWorkloadLabel:   *destinationWorkloadLabel,
+		SourceLabel:                *incomingSourceLabel,
+		SourceClasses:              *incomingSourceClasses,
+		Forwarded:                  *forwarded,
+		ProcPath:                   *procPath,
+		DNSHealth:                  *dnsHealth,
+		CPUStats:                   collector.NewCPUStats(),
+		PollInterval:               *pollInterval,
+		SourcePorts:                *trackSourcePorts,
+		ConnectionAge:              *trackConnectionAge,
+		SynSent:                    *trackSynSent,
+		MaxDestinationsPerWorkload: *maxDestinationsPerWorkload,
+		MaxSeries:                  *maxSeries,
+		ConnectionAttempts:         *source == "events",
+	}
+	if !opts.ConnectionAttempts {
+		log.Printf("conntrack_workload_connection_attempts_total is disabled, it requires -source=events\n")
+	}
+	if *netns {
+		log.Printf("Tracking connections of each workload network namespace from %s...\n", *procPath)
+		opts.NetNSConntrack, err = collector.NewNetNSConntrack(*protocol)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *markClassesFile != "" {
+		opts.MarkLabel = true
+		opts.MarkClasses, err = collector.LoadMarkClasses(*markClassesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *connlabelFile != "" {
+		opts.ConnlabelsLabel = true
+		opts.ConnlabelNames, err = collector.LoadConnlabelNames(*connlabelFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *dnsWorkers < 1 {
+		log.Fatalf("Invalid dns workers: %d, at least one is required", *dnsWorkers)
+	}
+	if *dnsQueueSize < 1 {
+		log.Fatalf("Invalid dns queue size: %d, at least one is required", *dnsQueueSize)
+	}
+	dnsCache := collector.NewDNSCache(*dnsWorkers, *dnsQueueSize, *dnsTimeout)
+	conntrackCollector, err := collector.New(engine, conntrack, workloadLabels, dnsCache, classifier, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	prometheus.MustRegister(collector)
+	prometheus.MustRegister(conntrackCollector, collector.NewStatsCollector(opts.CPUStats))
 	log.Printf("HTTP server listening at %s...\n", *addr)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
 
-func enableConntrackTimestamps() {
-	val, err := sysctl.Get(conntrackTimestampFlag)
+func enableConntrackFlag(flag string) {
+	val, err := sysctl.Get(flag)
 	if err != nil {
-		log.Printf("Could not get status of %s, err: %s", conntrackTimestampFlag, err.Error())
+		log.Printf("Could not get status of %s, err: %s", flag, err.Error())
 		return
 	}
 	if val == "1" {
-		log.Printf("Flag %s is already turned on", conntrackTimestampFlag)
+		log.Printf("Flag %s is already turned on", flag)
 		return
 	}
-	err = sysctl.Set(conntrackTimestampFlag, "1")
+	err = sysctl.Set(flag, "1")
 	if err != nil {
-		log.Printf("Could not set status of %s, err: %s", conntrackTimestampFlag, err.Error())
+		log.Printf("Could not set status of %s, err: %s", flag, err.Error())
 		return
 	}
 
-	log.Printf("Flag %s was turned on", conntrackTimestampFlag)
+	log.Printf("Flag %s was turned on", flag)
 
 }
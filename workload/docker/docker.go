@@ -43,11 +43,24 @@ func (d *dockerContainerEngine) Workloads() ([]*workload.Workload, error) {
 		if container.Config == nil {
 			continue
 		}
-		workloads = append(workloads, &workload.Workload{
+		ips := []string{}
+		if container.NetworkSettings.IPAddress != "" {
+			ips = append(ips, container.NetworkSettings.IPAddress)
+		}
+		if container.NetworkSettings.GlobalIPv6Address != "" {
+			ips = append(ips, container.NetworkSettings.GlobalIPv6Address)
+		}
+		w := &workload.Workload{
 			Name:   container.Name,
 			IP:     container.NetworkSettings.IPAddress,
+			IPs:    ips,
 			Labels: container.Config.Labels,
-		})
+		}
+		// containers on host network share the node network namespace
+		if container.HostConfig == nil || container.HostConfig.NetworkMode != "host" {
+			w.PID = container.State.Pid
+		}
+		workloads = append(workloads, w)
 	}
 	return workloads, nil
 }
@@ -11,6 +11,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/tsuru/prometheus-conntrack/workload"
@@ -28,6 +34,7 @@ type pod struct {
 type podMetadata struct {
 	Name      string            `json:"name"`
 	Namespace string            `json:"namespace"`
+	UID       string            `json:"uid"`
 	Labels    map[string]string `json:"labels"`
 }
 
@@ -36,7 +43,12 @@ type podSpec struct {
 }
 
 type podStatus struct {
-	PodIP string `json:"podIP"`
+	PodIP  string  `json:"podIP"`
+	PodIPs []podIP `json:"podIPs"`
+}
+
+type podIP struct {
+	IP string `json:"ip"`
 }
 
 type kubeletEngine struct {
@@ -44,8 +56,22 @@ type kubeletEngine struct {
 
 	client       *http.Client
 	tokenContent string
+
+	pidsMutex sync.Mutex
+	pids      map[string]podPID
+}
+
+// podPID is the cached process of a pod, pods without a process found yet are
+// cached with a zero pid until the next retry.
+type podPID struct {
+	pid     int
+	scanned time.Time
 }
 
+// podPIDRetryInterval is how long a pod without a process found waits before
+// the processes are scanned again.
+var podPIDRetryInterval = time.Minute
+
 func (d *kubeletEngine) Name() string {
 	return "kubernetes"
 }
@@ -76,6 +102,17 @@ func (k *kubeletEngine) Workloads() ([]*workload.Workload, error) {
 		return nil, err
 	}
 
+	var pids map[string]int
+	if k.ProcPath != "" {
+		uids := []string{}
+		for _, pod := range list.Items {
+			if !pod.Spec.HostNetwork {
+				uids = append(uids, pod.Metadata.UID)
+			}
+		}
+		pids = k.podPIDs(uids, time.Now())
+	}
+
 	for _, pod := range list.Items {
 		// we skip all pods with hostNetwork because its use the same ip of host
 		// and may generate a mess in the metrics
@@ -86,16 +123,105 @@ func (k *kubeletEngine) Workloads() ([]*workload.Workload, error) {
 			pod.Metadata.Labels = map[string]string{}
 		}
 		pod.Metadata.Labels["pod_namespace"] = pod.Metadata.Namespace
+		ips := []string{}
+		for _, podIP := range pod.Status.PodIPs {
+			ips = append(ips, podIP.IP)
+		}
 		workloads = append(workloads, &workload.Workload{
 			Name:   pod.Metadata.Name,
 			IP:     pod.Status.PodIP,
+			IPs:    ips,
 			Labels: pod.Metadata.Labels,
+			PID:    pids[pod.Metadata.UID],
 		})
 	}
 
 	return workloads, nil
 }
 
+// podCgroupRegexp matches the pod UID on cgroup paths of both cgroupfs
+// (ie: /kubepods/burstable/pod<uid>/...) and systemd drivers, where the
+// dashes of the UID are replaced by underscores.
+var podCgroupRegexp = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// podPIDs returns the cached process of each pod, the processes are only
+// scanned again for pods not seen before, whose process exited or without a
+// process found for podPIDRetryInterval.
+func (k *kubeletEngine) podPIDs(uids []string, now time.Time) map[string]int {
+	k.pidsMutex.Lock()
+	defer k.pidsMutex.Unlock()
+
+	scan := false
+	for _, uid := range uids {
+		cached, ok := k.pids[uid]
+		switch {
+		case !ok:
+			scan = true
+		case cached.pid == 0:
+			scan = scan || now.Sub(cached.scanned) >= podPIDRetryInterval
+		default:
+			scan = scan || !podProcessAlive(k.ProcPath, cached.pid, uid)
+		}
+	}
+
+	var scanned map[string]int
+	if scan {
+		scanned = podPIDs(k.ProcPath)
+	}
+
+	cache := map[string]podPID{}
+	pids := map[string]int{}
+	for _, uid := range uids {
+		cached := k.pids[uid]
+		if scan {
+			cached = podPID{pid: scanned[uid], scanned: now}
+		}
+		cache[uid] = cached
+		if cached.pid != 0 {
+			pids[uid] = cached.pid
+		}
+	}
+	k.pids = cache
+	return pids
+}
+
+// podProcessAlive checks that pid still runs on the cgroup of the pod, pids are
+// reused once the process exits.
+func podProcessAlive(procPath string, pid int, uid string) bool {
+	content, err := os.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return false
+	}
+	match := podCgroupRegexp.FindStringSubmatch(string(content))
+	return match != nil && strings.ReplaceAll(match[1], "_", "-") == uid
+}
+
+// podPIDs finds a process of each pod by its cgroup, every process of a pod
+// shares the same network namespace.
+func podPIDs(procPath string) map[string]int {
+	pids := map[string]int{}
+	cgroupFiles, _ := filepath.Glob(filepath.Join(procPath, "[0-9]*", "cgroup"))
+	for _, cgroupFile := range cgroupFiles {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(cgroupFile)))
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(cgroupFile)
+		if err != nil {
+			continue
+		}
+		match := podCgroupRegexp.FindStringSubmatch(string(content))
+		if match == nil {
+			continue
+		}
+		uid := strings.ReplaceAll(match[1], "_", "-")
+		if _, ok := pids[uid]; !ok || pid < pids[uid] {
+			pids[uid] = pid
+		}
+	}
+	return pids
+}
+
 type Opts struct {
 	Endpoint string
 	Key      string
@@ -103,6 +229,10 @@ type Opts struct {
 	CA       string
 	Token    string
 
+	// ProcPath is the mount point of the host procfs, when set the pods
+	// are discovered with a PID to reach their network namespaces
+	ProcPath string
+
 	InsecureSkipVerify bool
 }
 
@@ -8,7 +8,10 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -22,12 +25,14 @@ func TestListWorkloads(t *testing.T) {
 					Metadata: podMetadata{
 						Name:      "my-pod",
 						Namespace: "tsuru",
+						UID:       "6b1c1d5e-2f3a-4c5b-8d7e-9f0a1b2c3d4e",
 						Labels: map[string]string{
 							"version": "v3",
 						},
 					},
 					Status: podStatus{
-						PodIP: "10.27.24.12",
+						PodIP:  "10.27.24.12",
+						PodIPs: []podIP{{IP: "10.27.24.12"}, {IP: "fd00:10:27::c"}},
 					},
 				},
 				{
@@ -51,15 +56,66 @@ func TestListWorkloads(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	engine, err := NewEngine(Opts{Endpoint: ts.URL})
+	procPath := t.TempDir()
+	writeCgroup(t, procPath, "4242", "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod6b1c1d5e_2f3a_4c5b_8d7e_9f0a1b2c3d4e.slice/cri-containerd-abc.scope\n")
+
+	engine, err := NewEngine(Opts{Endpoint: ts.URL, ProcPath: procPath})
 	require.NoError(t, err)
 	workloads, err := engine.Workloads()
 	require.NoError(t, err)
 	assert.Len(t, workloads, 1)
 	assert.Equal(t, workloads[0].Name, "my-pod")
 	assert.Equal(t, workloads[0].IP, "10.27.24.12")
+	assert.Equal(t, workloads[0].IPs, []string{"10.27.24.12", "fd00:10:27::c"})
+	assert.Equal(t, workloads[0].PID, 4242)
 	assert.Equal(t, workloads[0].Labels, map[string]string{
 		"pod_namespace": "tsuru",
 		"version":       "v3",
 	})
 }
+
+func writeCgroup(t *testing.T, procPath, pid, content string) {
+	err := os.MkdirAll(filepath.Join(procPath, pid), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(procPath, pid, "cgroup"), []byte(content), 0644)
+	require.NoError(t, err)
+}
+
+func TestPodPIDs(t *testing.T) {
+	procPath := t.TempDir()
+	writeCgroup(t, procPath, "100", "11:memory:/kubepods/burstable/pod0d3b7c2a-1111-2222-3333-444455556666/abc\n")
+	writeCgroup(t, procPath, "50", "11:memory:/kubepods/burstable/pod0d3b7c2a-1111-2222-3333-444455556666/def\n")
+	writeCgroup(t, procPath, "200", "0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod9a8b7c6d_1111_2222_3333_444455556666.slice/cri-containerd-abc.scope\n")
+	writeCgroup(t, procPath, "1", "0::/init.scope\n")
+
+	assert.Equal(t, map[string]int{
+		"0d3b7c2a-1111-2222-3333-444455556666": 50,
+		"9a8b7c6d-1111-2222-3333-444455556666": 200,
+	}, podPIDs(procPath))
+}
+
+func TestPodPIDsCache(t *testing.T) {
+	procPath := t.TempDir()
+	uid1, uid2 := "0d3b7c2a-1111-2222-3333-444455556666", "9a8b7c6d-1111-2222-3333-444455556666"
+	writeCgroup(t, procPath, "100", "11:memory:/kubepods/burstable/pod"+uid1+"/abc\n")
+	k := &kubeletEngine{Opts: Opts{ProcPath: procPath}}
+	now := time.Now()
+
+	assert.Equal(t, map[string]int{uid1: 100}, k.podPIDs([]string{uid1, uid2}, now))
+
+	// cached, new processes are not seen until the retry interval
+	writeCgroup(t, procPath, "50", "11:memory:/kubepods/burstable/pod"+uid1+"/def\n")
+	writeCgroup(t, procPath, "200", "11:memory:/kubepods/burstable/pod"+uid2+"/abc\n")
+	assert.Equal(t, map[string]int{uid1: 100}, k.podPIDs([]string{uid1, uid2}, now.Add(time.Second)))
+
+	now = now.Add(podPIDRetryInterval)
+	assert.Equal(t, map[string]int{uid1: 50, uid2: 200}, k.podPIDs([]string{uid1, uid2}, now))
+
+	// the process exited and its pid was reused by another pod
+	writeCgroup(t, procPath, "50", "11:memory:/kubepods/burstable/pod"+uid2+"/def\n")
+	assert.Equal(t, map[string]int{uid1: 100, uid2: 50}, k.podPIDs([]string{uid1, uid2}, now.Add(time.Second)))
+
+	// deleted pods are dropped from the cache
+	k.podPIDs([]string{uid2}, now.Add(time.Second))
+	assert.NotContains(t, k.pids, uid1)
+}
@@ -4,10 +4,44 @@
 
 package workload
 
+import (
+	"path/filepath"
+	"strconv"
+)
+
 type Workload struct {
 	Name   string
 	IP     string
+	IPs    []string
 	Labels map[string]string
+	// NetNS is the path of the workload network namespace, engines that
+	// only know a process of the workload fill PID instead
+	NetNS string
+	PID   int
+}
+
+// Addresses returns every address of the workload, on dual-stack workloads
+// IPs contains both IPv4 and IPv6 addresses and IP only the primary one.
+func (w *Workload) Addresses() []string {
+	if len(w.IPs) > 0 {
+		return w.IPs
+	}
+
+	return []string{w.IP}
+}
+
+// NetNSPath returns the path of the workload network namespace, procPath is
+// the mount point of the host procfs. It is empty when the engine does not
+// know the namespace of the workload.
+func (w *Workload) NetNSPath(procPath string) string {
+	if w.NetNS != "" {
+		return w.NetNS
+	}
+	if w.PID > 0 {
+		return filepath.Join(procPath, strconv.Itoa(w.PID), "ns", "net")
+	}
+
+	return ""
 }
 
 type Engine interface {